@@ -0,0 +1,139 @@
+package bgp
+
+// Advertisement of multiple paths, RFC 7911.
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// AddPathFamily is a family in the ADD-PATH capability.
+type AddPathFamily struct {
+	Family
+	Receive bool // Able to receive multiple paths.
+	Send    bool // Able to send multiple paths.
+}
+
+// addPathBytes returns the value of the ADD-PATH capability for families.
+func addPathBytes(families []AddPathFamily) []byte {
+	var buf []byte
+	for _, f := range families {
+		mode := byte(0)
+		if f.Receive {
+			mode |= 1
+		}
+		if f.Send {
+			mode |= 2
+		}
+		buf = append(buf, f.Family.bytes()...)
+		buf = append(buf, mode)
+	}
+	return buf
+}
+
+// setAddPath returns the families in the ADD-PATH capability value buf, or false if buf
+// is malformed.
+func setAddPath(buf []byte) ([]AddPathFamily, bool) {
+	if len(buf)%4 != 0 {
+		return nil, false
+	}
+	var families []AddPathFamily
+	for i := 0; i < len(buf); i += 4 {
+		mode := buf[i+3]
+		if mode == 0 || mode > 3 {
+			return nil, false
+		}
+		f := Family{binary.BigEndian.Uint16(buf[i:]), buf[i+2]}
+		families = append(families, AddPathFamily{f, mode&1 != 0, mode&2 != 0})
+	}
+	return families, true
+}
+
+// negotiateAddPath returns the families in which we receive and send multiple paths: we
+// receive when we advertised Receive and the peer Send, and the other way around.
+func negotiateAddPath(local, peer []AddPathFamily) []AddPathFamily {
+	var families []AddPathFamily
+	for _, l := range local {
+		for _, p := range peer {
+			if l.Family != p.Family {
+				continue
+			}
+			if f := (AddPathFamily{l.Family, l.Receive && p.Send, l.Send && p.Receive}); f.Receive || f.Send {
+				families = append(families, f)
+			}
+		}
+	}
+	return families
+}
+
+// receivePathIDs returns the families in which the NLRI received from the peer carry
+// path identifiers.
+func (s State) receivePathIDs() map[Family]bool {
+	var m map[Family]bool
+	for _, f := range s.AddPath {
+		if f.Receive {
+			if m == nil {
+				m = map[Family]bool{}
+			}
+			m[f.Family] = true
+		}
+	}
+	return m
+}
+
+// SendPathIDs returns true if multiple paths, with path identifiers, are sent to the
+// peer in family f.
+func (s State) SendPathIDs(f Family) bool {
+	for _, a := range s.AddPath {
+		if a.Family == f {
+			return a.Send
+		}
+	}
+	return false
+}
+
+// setPathPrefixes returns all prefixes encoded in buf, each preceded by its path
+// identifier, and the path identifiers. See Prefix.setBytes.
+func setPathPrefixes(buf []byte, bits int) ([]Prefix, []uint32, error) {
+	var (
+		prefixes []Prefix
+		ids      []uint32
+	)
+	for i := 0; i < len(buf); {
+		if len(buf[i:]) < 4 {
+			return nil, nil, NewError(3, 10, fmt.Sprintf("path identifier overruns buffer: %d < 4", len(buf[i:])))
+		}
+		ids = append(ids, binary.BigEndian.Uint32(buf[i:]))
+		i += 4
+		p := Prefix{}
+		n, err := p.setBytes(buf[i:], bits)
+		if err != nil {
+			return nil, nil, err
+		}
+		i += n
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, ids, nil
+}
+
+// appendPrefixes appends prefixes in wire format to buf. If ids is not nil, every prefix
+// is preceded by its path identifier in ids.
+func appendPrefixes(buf []byte, prefixes []Prefix, ids []uint32) []byte {
+	for i := range prefixes {
+		if ids != nil {
+			buf = binary.BigEndian.AppendUint32(buf, ids[i])
+		}
+		buf = append(buf, prefixes[i].bytes()...)
+	}
+	return buf
+}
+
+// decodePrefixes returns the prefixes in buf, with their path identifiers when addPath
+// is true, otherwise the returned path identifiers are nil.
+func decodePrefixes(buf []byte, bits int, addPath bool) ([]Prefix, []uint32, error) {
+	if addPath {
+		return setPathPrefixes(buf, bits)
+	}
+	prefixes, err := setPrefixes(buf, bits)
+	return prefixes, nil, err
+}
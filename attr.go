@@ -4,7 +4,9 @@ package bgp
 
 import (
 	"encoding/binary"
+	"fmt"
 	"net"
+	"strconv"
 )
 
 // Define the types used for well-known path attributes in an Update message.
@@ -18,6 +20,20 @@ const (
 	atomic_aggregate
 	aggregator
 	communities
+
+	mp_reach_nlri    = 14 // RFC 4760
+	mp_unreach_nlri  = 15 // RFC 4760
+	only_to_customer = 35 // RFC 9234
+)
+
+// Address family and subsequent address family identifiers, as used in MP_REACH_NLRI,
+// MP_UNREACH_NLRI and the multiprotocol capability.
+const (
+	AFI_IP  = 1
+	AFI_IP6 = 2
+
+	SAFI_UNICAST   = 1
+	SAFI_MULTICAST = 2
 )
 
 // Values used in the well-known path attributes.
@@ -41,39 +57,70 @@ const AS_TRANS = 23456
 
 // Path attribute header flags.
 const (
-	FlagOptional   = 1 << 8
-	FlagTransitive = 1 << 7
-	FlagPartial    = 1 << 6
-	FlagLength     = 1 << 5
+	FlagOptional   = 1 << 7
+	FlagTransitive = 1 << 6
+	FlagPartial    = 1 << 5
+	FlagLength     = 1 << 4
 )
 
+// attrFlags holds the flags that are used when none are set in an Attribute.
+var attrFlags = map[int]uint8{
+	origin:           FlagTransitive,
+	path:             FlagTransitive,
+	next_hop:         FlagTransitive,
+	multi_exit_disc:  FlagOptional,
+	local_pref:       FlagTransitive,
+	atomic_aggregate: FlagTransitive,
+	aggregator:       FlagOptional | FlagTransitive,
+	communities:      FlagOptional | FlagTransitive,
+	mp_reach_nlri:    FlagOptional,
+	mp_unreach_nlri:  FlagOptional,
+	only_to_customer: FlagOptional | FlagTransitive,
+}
+
 // Attribute is a path attribute as used in the Update message.
 type Attribute struct {
 	Flags  uint8
 	Code   uint8
-	Length uint16
+	Length uint16 // Length of the value when decoded, Bytes leaves it untouched.
 	data   []TLV
 
 	// maybe put the data in a map based on Code. So Cel
 }
 
+// Append adds v to the attribute and sets its code to t. If no flags have been
+// set the default flags for t are used.
 func (p *Attribute) Append(t int, v TLV) error {
 	p.Code = uint8(t)
+	if p.Flags == 0 {
+		p.Flags = attrFlags[t]
+	}
 	p.data = append(p.data, v)
 	return nil
 }
 
+// Value returns the first value of the attribute, or nil if there is none.
+func (p *Attribute) Value() TLV {
+	if len(p.data) == 0 {
+		return nil
+	}
+	return p.data[0]
+}
+
+// Bytes returns the attribute in wire format. It does not modify p, so shared
+// (interned) attributes can be encoded from multiple goroutines.
 func (p *Attribute) Bytes() []byte {
 	buf := []byte{}
 	for _, d := range p.data {
 		buf = append(buf, d.Bytes()...)
 	}
+
 	header := make([]byte, 4)
-	header[0] = p.Flags
+	header[0] = p.Flags &^ FlagLength
 	header[1] = p.Code
-	if len(buf) > 65536-1 {
+	if len(buf) > 255 {
 		header[0] |= FlagLength
-		binary.BigEndian.PutUint16(header[2:], uint16(p.Length))
+		binary.BigEndian.PutUint16(header[2:], uint16(len(buf)))
 	} else {
 		header[2] = uint8(len(buf))
 		header = header[:3]
@@ -81,22 +128,105 @@ func (p *Attribute) Bytes() []byte {
 	return append(header, buf...)
 }
 
-func (p *Attribute) SetBytes(buf []byte) (int, error) {
-	// TODO(Miek): does not work.
+// SetBytes sets the attribute from buf. Unrecognized optional transitive attributes
+// are kept as a Raw value with the Partial flag set, so they are passed on as such
+// (RFC 4271, Section 5), unrecognized optional non-transitive attributes are
+// skipped: the returned offset is moved past them, but no value is set. An
+// unrecognized well-known attribute is an error.
+func (p *Attribute) SetBytes(buf []byte) (int, error) { return p.decode(buf, nil) }
+
+// decode is SetBytes, the NLRI in MP_REACH_NLRI and MP_UNREACH_NLRI of the families in
+// addPath are decoded with path identifiers.
+func (p *Attribute) decode(buf []byte, addPath map[Family]bool) (int, error) {
 	if len(buf) < 3 {
-		return 0, errBuf
+		return 0, NewError(3, 1, "attribute header too short")
 	}
 	p.Flags = buf[0]
 	p.Code = buf[1]
+	offset := 3
 	if p.Flags&FlagLength == FlagLength {
 		if len(buf) < 4 {
-			return 2, errBuf
+			return 0, NewError(3, 1, "attribute header too short")
 		}
 		p.Length = binary.BigEndian.Uint16(buf[2:])
-		return 4, nil
+		offset = 4
+	} else {
+		p.Length = uint16(buf[2])
+	}
+	end := offset + int(p.Length)
+	if len(buf) < end {
+		return 0, NewError(3, 1, fmt.Sprintf("attribute %d overruns attribute list: %d < %d", p.Code, len(buf), end))
+	}
+
+	var v TLV
+	switch p.Code {
+	case origin:
+		v = new(Origin)
+	case path:
+		v = new(Path)
+	case next_hop:
+		v = new(NextHop)
+	case multi_exit_disc:
+		v = new(MultiExitDisc)
+	case local_pref:
+		v = new(LocalPref)
+	case atomic_aggregate:
+		v = new(AtomicAggregate)
+	case aggregator:
+		v = new(Aggregator)
+	case communities:
+		v = new(Community)
+	case mp_reach_nlri:
+		v = new(MPReach)
+	case mp_unreach_nlri:
+		v = new(MPUnreach)
+	case only_to_customer:
+		v = new(OnlyToCustomer)
+	default:
+		if p.Flags&FlagOptional == 0 {
+			return end, attrError(NewError(3, 2, fmt.Sprintf("attribute %d", p.Code)), buf[:end])
+		}
+		if p.Flags&FlagTransitive == 0 {
+			return end, nil
+		}
+		p.Flags |= FlagPartial
+		v = new(Raw)
+	}
+	// The value is set even on error, so the caller can see how far parsing got.
+	p.data = []TLV{v}
+	var err error
+	switch v := v.(type) {
+	case *MPReach:
+		_, err = v.decode(buf[offset:end], addPath)
+	case *MPUnreach:
+		_, err = v.decode(buf[offset:end], addPath)
+	default:
+		_, err = v.SetBytes(buf[offset:end])
+	}
+	if err != nil {
+		return end, attrError(err.(*Error), buf[:end])
+	}
+	if f, ok := attrFlags[int(p.Code)]; ok && p.Flags&(FlagOptional|FlagTransitive) != f {
+		return end, attrError(NewError(3, 4, fmt.Sprintf("attribute %d flags: %08b", p.Code, p.Flags)), buf[:end])
+	}
+	return end, nil
+}
+
+// attrError sets the data of e to a copy of the attribute attr, as required for most
+// UPDATE errors, and returns e.
+func attrError(e *Error, attr []byte) *Error {
+	e.Data = append([]byte(nil), attr...)
+	return e
+}
+
+// findAttr returns the first attribute with code t in attrs, or nil if there is none.
+func findAttr(attrs []Attribute, t int) *Attribute {
+	for i := range attrs {
+		if int(attrs[i].Code) == t {
+			return &attrs[i]
+		}
 	}
-	p.Length = uint16(buf[2])
-	return 3, nil
+	return nil
 }
 
 // Origin implements the ORIGIN path attribute.
@@ -104,8 +234,11 @@ type Origin uint8
 
 func (p *Origin) Bytes() []byte { return []byte{uint8(*p)} }
 func (p *Origin) SetBytes(buf []byte) (int, error) {
-	if len(buf) < 1 {
-		return 0, errBuf
+	if len(buf) != 1 {
+		return 0, NewError(3, 5, "ORIGIN must be 1 byte")
+	}
+	if buf[0] > INCOMPLETE {
+		return 0, NewError(3, 6, fmt.Sprintf("unknown origin: %d", buf[0]))
 	}
 	*p = Origin(buf[0])
 	return 1, nil
@@ -123,8 +256,11 @@ func (p *Community) Bytes() []byte {
 }
 
 func (p *Community) SetBytes(buf []byte) (int, error) {
+	if len(buf)%4 != 0 {
+		return 0, NewError(3, 9, "COMMUNITIES length not a multiple of 4")
+	}
 	offset := 0
-	for offset < len(buf)-4 {
+	for offset+4 <= len(buf) {
 		*p = append(*p, binary.BigEndian.Uint32(buf[offset:]))
 		offset += 4
 	}
@@ -157,15 +293,257 @@ func (p *Path) Bytes() []byte {
 }
 
 func (p *Path) SetBytes(buf []byte) (int, error) {
-	return 0, nil
+	offset := 0
+	for offset < len(buf) {
+		if len(buf)-offset < 2 {
+			return offset, NewError(3, 11, "segment header too short")
+		}
+		a := AsPath{Type: buf[offset]}
+		if a.Type != AS_SET && a.Type != AS_SEQUENCE {
+			return offset, NewError(3, 11, fmt.Sprintf("unknown segment type: %d", a.Type))
+		}
+		n := int(buf[offset+1])
+		offset += 2
+		if len(buf)-offset < 4*n {
+			return offset, NewError(3, 11, "segment overruns attribute")
+		}
+		for i := 0; i < n; i++ {
+			a.AS = append(a.AS, binary.BigEndian.Uint32(buf[offset:]))
+			offset += 4
+		}
+		*p = append(*p, a)
+	}
+	return offset, nil
 }
 
+// NextHop implements the NEXT_HOP path attribute.
 type NextHop net.IP
 
-func (p *NextHop) Bytes() []byte {
-	return nil
-}
+func (p *NextHop) Bytes() []byte { return []byte(net.IP(*p).To4()) }
 
 func (p *NextHop) SetBytes(buf []byte) (int, error) {
+	if len(buf) != 4 {
+		return 0, NewError(3, 5, "NEXT_HOP must be 4 bytes")
+	}
+	*p = NextHop(net.IPv4(buf[0], buf[1], buf[2], buf[3]))
+	return 4, nil
+}
+
+// MultiExitDisc implements the MULTI_EXIT_DISC path attribute.
+type MultiExitDisc uint32
+
+func (p *MultiExitDisc) Bytes() []byte { return uint32Bytes(uint32(*p)) }
+
+func (p *MultiExitDisc) SetBytes(buf []byte) (int, error) {
+	if len(buf) != 4 {
+		return 0, NewError(3, 5, "MULTI_EXIT_DISC must be 4 bytes")
+	}
+	*p = MultiExitDisc(binary.BigEndian.Uint32(buf))
+	return 4, nil
+}
+
+// LocalPref implements the LOCAL_PREF path attribute.
+type LocalPref uint32
+
+func (p *LocalPref) Bytes() []byte { return uint32Bytes(uint32(*p)) }
+
+func (p *LocalPref) SetBytes(buf []byte) (int, error) {
+	if len(buf) != 4 {
+		return 0, NewError(3, 5, "LOCAL_PREF must be 4 bytes")
+	}
+	*p = LocalPref(binary.BigEndian.Uint32(buf))
+	return 4, nil
+}
+
+// AtomicAggregate implements the ATOMIC_AGGREGATE path attribute, it has no value.
+type AtomicAggregate struct{}
+
+func (p *AtomicAggregate) Bytes() []byte { return nil }
+
+func (p *AtomicAggregate) SetBytes(buf []byte) (int, error) {
+	if len(buf) != 0 {
+		return 0, NewError(3, 5, "ATOMIC_AGGREGATE must be empty")
+	}
 	return 0, nil
 }
+
+// Aggregator implements the AGGREGATOR path attribute with a 32 bit AS number.
+type Aggregator struct {
+	AS uint32
+	IP net.IP
+}
+
+func (p *Aggregator) Bytes() []byte {
+	return append(uint32Bytes(p.AS), p.IP.To4()...)
+}
+
+func (p *Aggregator) SetBytes(buf []byte) (int, error) {
+	if len(buf) != 8 {
+		return 0, NewError(3, 5, "AGGREGATOR must be 8 bytes")
+	}
+	p.AS = binary.BigEndian.Uint32(buf)
+	p.IP = net.IPv4(buf[4], buf[5], buf[6], buf[7])
+	return 8, nil
+}
+
+// OnlyToCustomer implements the RFC 9234 OTC path attribute. It holds the AS number
+// of the AS that first marked the route as only to be sent to customers.
+type OnlyToCustomer uint32
+
+func (p *OnlyToCustomer) Bytes() []byte { return uint32Bytes(uint32(*p)) }
+
+func (p *OnlyToCustomer) SetBytes(buf []byte) (int, error) {
+	if len(buf) != 4 {
+		return 0, NewError(3, 5, "OTC must be 4 bytes")
+	}
+	*p = OnlyToCustomer(binary.BigEndian.Uint32(buf))
+	return 4, nil
+}
+
+// Family is an address family: the AFI/SAFI pair.
+type Family struct {
+	AFI  uint16
+	SAFI uint8
+}
+
+func (f Family) String() string {
+	s := strconv.Itoa(int(f.AFI)) + "/" + strconv.Itoa(int(f.SAFI))
+	switch f {
+	case Family{AFI_IP, SAFI_UNICAST}:
+		s = "ipv4 unicast"
+	case Family{AFI_IP, SAFI_MULTICAST}:
+		s = "ipv4 multicast"
+	case Family{AFI_IP6, SAFI_UNICAST}:
+		s = "ipv6 unicast"
+	case Family{AFI_IP6, SAFI_MULTICAST}:
+		s = "ipv6 multicast"
+	}
+	return s
+}
+
+// bits returns the length of an address in f, or 0 if the prefixes of f are not
+// understood by this package.
+func (f Family) bits() int {
+	if f.SAFI != SAFI_UNICAST && f.SAFI != SAFI_MULTICAST {
+		return 0
+	}
+	switch f.AFI {
+	case AFI_IP:
+		return 32
+	case AFI_IP6:
+		return 128
+	}
+	return 0
+}
+
+func (f Family) bytes() []byte {
+	return []byte{byte(f.AFI >> 8), byte(f.AFI), f.SAFI}
+}
+
+// MPReach implements the MP_REACH_NLRI path attribute, RFC 4760. The NLRI of families
+// not understood by this package are kept in wire format.
+type MPReach struct {
+	Family
+	NextHop []net.IP // One next hop, or for IPv6 optionally the global and link local next hop.
+	NLRI    []Prefix
+	PathIDs []uint32 // Path identifiers of NLRI when ADD-PATH is used for the family, or nil.
+
+	raw []byte
+}
+
+func (p *MPReach) Bytes() []byte {
+	buf := p.Family.bytes()
+	nh := []byte{}
+	for _, ip := range p.NextHop {
+		if p.AFI == AFI_IP {
+			nh = append(nh, ip.To4()...)
+			continue
+		}
+		nh = append(nh, ip.To16()...)
+	}
+	buf = append(buf, byte(len(nh)))
+	buf = append(buf, nh...)
+	buf = append(buf, 0) // reserved
+	buf = appendPrefixes(buf, p.NLRI, p.PathIDs)
+	return append(buf, p.raw...)
+}
+
+func (p *MPReach) SetBytes(buf []byte) (int, error) { return p.decode(buf, nil) }
+
+// decode is SetBytes, the NLRI are decoded with path identifiers if the family is in
+// addPath.
+func (p *MPReach) decode(buf []byte, addPath map[Family]bool) (int, error) {
+	if len(buf) < 5 {
+		return 0, NewError(3, 9, "MP_REACH_NLRI too short")
+	}
+	p.AFI = binary.BigEndian.Uint16(buf)
+	p.SAFI = buf[2]
+	n := int(buf[3])
+	if len(buf) < 5+n {
+		return 3, NewError(3, 9, "MP_REACH_NLRI next hop overruns attribute")
+	}
+	nh := buf[4 : 4+n]
+	switch {
+	case n == 4 && p.AFI == AFI_IP:
+		p.NextHop = []net.IP{net.IPv4(nh[0], nh[1], nh[2], nh[3])}
+	case n == 16 && p.AFI == AFI_IP6:
+		p.NextHop = []net.IP{net.IP(append([]byte(nil), nh...))}
+	case n == 32 && p.AFI == AFI_IP6:
+		p.NextHop = []net.IP{net.IP(append([]byte(nil), nh[:16]...)), net.IP(append([]byte(nil), nh[16:]...))}
+	case p.bits() != 0:
+		return 3, NewError(3, 9, fmt.Sprintf("MP_REACH_NLRI next hop length %d for %s", n, p.Family))
+	}
+	// Skip the reserved byte.
+	bits := p.bits()
+	if bits == 0 {
+		p.raw = append([]byte(nil), buf[5+n:]...)
+		return len(buf), nil
+	}
+	var err error
+	if p.NLRI, p.PathIDs, err = decodePrefixes(buf[5+n:], bits, addPath[p.Family]); err != nil {
+		return 3, err
+	}
+	return len(buf), nil
+}
+
+// MPUnreach implements the MP_UNREACH_NLRI path attribute, RFC 4760. The withdrawn
+// routes of families not understood by this package are kept in wire format.
+type MPUnreach struct {
+	Family
+	WithdrawnRoutes []Prefix
+	PathIDs         []uint32 // Path identifiers of WithdrawnRoutes, see MPReach.
+
+	raw []byte
+}
+
+func (p *MPUnreach) Bytes() []byte {
+	buf := appendPrefixes(p.Family.bytes(), p.WithdrawnRoutes, p.PathIDs)
+	return append(buf, p.raw...)
+}
+
+func (p *MPUnreach) SetBytes(buf []byte) (int, error) { return p.decode(buf, nil) }
+
+// decode is SetBytes, see MPReach.decode.
+func (p *MPUnreach) decode(buf []byte, addPath map[Family]bool) (int, error) {
+	if len(buf) < 3 {
+		return 0, NewError(3, 9, "MP_UNREACH_NLRI too short")
+	}
+	p.AFI = binary.BigEndian.Uint16(buf)
+	p.SAFI = buf[2]
+	bits := p.bits()
+	if bits == 0 {
+		p.raw = append([]byte(nil), buf[3:]...)
+		return len(buf), nil
+	}
+	var err error
+	if p.WithdrawnRoutes, p.PathIDs, err = decodePrefixes(buf[3:], bits, addPath[p.Family]); err != nil {
+		return 3, err
+	}
+	return len(buf), nil
+}
+
+func uint32Bytes(v uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, v)
+	return buf
+}
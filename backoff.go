@@ -0,0 +1,93 @@
+package bgp
+
+// Connect retry and damping of peer oscillations, RFC 4271, Sections 8.1.1 and 10.
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	// maxIdleHoldTime is the default upper bound of the time between connection attempts
+	// when peer oscillations are damped.
+	maxIdleHoldTime = time.Hour
+	// stableTime is how long a session must be established before earlier failures are
+	// forgotten.
+	stableTime = 10 * time.Minute
+)
+
+// Backoff is the state of the connection attempts to an active neighbor.
+type Backoff struct {
+	Failures  int           // Failed connection attempts and sessions since the last stable session.
+	Delay     time.Duration // Time between the last failure and the next attempt.
+	Next      time.Time     // Time of the next attempt, zero when connecting or connected.
+	LastError error         // The error of the last failure.
+	// HoldDown is the time until which connections with the neighbor are refused,
+	// after it exceeded a prefix limit with a RestartAfter.
+	HoldDown time.Time
+}
+
+// Backoff returns the state of the connection attempts to n.
+func (n *Neighbor) Backoff() Backoff {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.backoff
+}
+
+// Backoff returns the state of the connection attempts to the neighbor of s, this is
+// the zero Backoff when s was not set up by a Server for a configured neighbor.
+func (s *Session) Backoff() Backoff {
+	if s.neighbor == nil {
+		return Backoff{}
+	}
+	return s.neighbor.Backoff()
+}
+
+// retry records a failed connection attempt, or a session that ended after being
+// established for up, and returns the time to wait before the next attempt.
+func (srv *Server) retry(n *Neighbor, up time.Duration, err error) time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	b := &n.backoff
+	if up >= stableTime {
+		b.Failures = 0
+	}
+	b.Failures++
+	b.LastError = err
+
+	d := srv.ConnectRetryTime
+	if d == 0 {
+		d = connectRetryTime
+	}
+	if srv.DampPeerOscillations {
+		max := srv.MaxIdleHoldTime
+		if max == 0 {
+			max = maxIdleHoldTime
+		}
+		for i := 1; i < b.Failures && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+	}
+	now := srv.clock().Now()
+	b.Delay = jitter(d)
+	if now.Add(b.Delay).Before(b.HoldDown) {
+		b.Delay = b.HoldDown.Sub(now)
+	}
+	b.Next = now.Add(b.Delay)
+	return b.Delay
+}
+
+// connecting clears the time of the next attempt for n.
+func (n *Neighbor) connecting() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.backoff.Next = time.Time{}
+}
+
+// jitter returns a random duration between 75% and 100% of d, RFC 4271, Section 10.
+func jitter(d time.Duration) time.Duration {
+	return d*3/4 + time.Duration(rand.Int63n(int64(d/4)+1))
+}
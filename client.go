@@ -1,30 +1,52 @@
 package bgp
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
 )
 
 // Do sends a bgp message to the connection conn and waits for a reply.
 // The reply message is returned or an error, if one is encountered.
 func Do(conn net.Conn, m Msg) (Msg, error) {
-	buf := bytes(m)
-	n, err := conn.Write(buf)
-	if err != nil {
+	if err := writeMsg(conn, m); err != nil {
 		return nil, err
 	}
+	return readMsg(conn)
+}
+
+// writeMsg writes m in wire format to w.
+func writeMsg(w io.Writer, m Msg) error {
+	_, err := w.Write(bytes(m))
+	return err
+}
+
+// readMsg reads exactly one message from r. The header is checked before the
+// rest of the message is read. See setBytes for UPDATE errors.
+func readMsg(r io.Reader) (Msg, error) { return readAddPathMsg(r, nil, MaxSize) }
 
-	buf1 := make([]byte, MaxSize)
-	n, err = conn.Read(buf1)
-	if err != nil {
+// readAddPathMsg is readMsg, the NLRI of the families in addPath are decoded with
+// path identifiers and messages of up to size bytes are accepted.
+func readAddPathMsg(r io.Reader, addPath map[Family]bool, size int) (Msg, error) {
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf[:headerLen]); err != nil {
 		return nil, err
 	}
-	buf1 = buf1[:n]
-
-	fmt.Printf("%v\n", buf1)
-	m1, n, err := setBytes(buf1)
-	if err != nil {
+	for i := 0; i < 16; i++ {
+		if buf[i] != 0xff {
+			return nil, NewError(1, 1, "marker not all ones")
+		}
+	}
+	length := int(binary.BigEndian.Uint16(buf[16:]))
+	if length < headerLen || length > size {
+		e := NewError(1, 2, fmt.Sprintf("bad length: %d", length))
+		e.Data = append([]byte(nil), buf[16:18]...)
+		return nil, e
+	}
+	if _, err := io.ReadFull(r, buf[headerLen:length]); err != nil {
 		return nil, err
 	}
-	return m1, nil
+	m, _, err := decode(buf[:length], addPath)
+	return m, err
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net"
 
@@ -10,8 +11,12 @@ import (
 // Connect to a BGP server and send an Open message with a parameters
 // advertizing that we can do 32 bit ASN.
 
+var gtsm = flag.Bool("gtsm", false, "protect the session with GTSM, the server must be directly connected")
+
 func main() {
-	conn, err := net.Dial("tcp", "localhost:179")
+	flag.Parse()
+	t := &bgp.Transport{TTLSecurity: *gtsm}
+	conn, err := t.Dial("tcp", "localhost:179")
 	if err != nil {
 		log.Fatalf("%s", err)
 	}
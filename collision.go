@@ -0,0 +1,105 @@
+package bgp
+
+// Connection collision detection, RFC 4271, Section 6.8.
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// Collisions tracks the sessions of a speaker to detect connection collisions: two
+// connections between the same pair of speakers, one initiated by each side. Sessions
+// that share a Collisions have it set in their Collisions field.
+type Collisions struct {
+	mu       sync.Mutex
+	sessions map[peerKey]*collision
+}
+
+// peerKey identifies a peer: a BGP identifier is only unique within an AS, RFC 6286.
+type peerKey struct {
+	as uint32
+	id uint32
+}
+
+// peerKey returns the key of the peer of s.
+func (s *Session) peerKey() peerKey {
+	return peerKey{s.state.AS, binary.BigEndian.Uint32(s.state.BGPIdentifier.To4())}
+}
+
+type collision struct {
+	s           *Session
+	established bool
+}
+
+// resolve registers s, which has just received the peer's OPEN, and returns the session
+// that must be closed, or nil if there is no collision. An established session always
+// wins, otherwise the connection initiated by the speaker with the higher BGP identifier
+// is kept, or, when the identifiers are equal, the one with the higher AS number,
+// RFC 6286, Section 2.3.
+func (c *Collisions) resolve(s *Session) *Session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sessions == nil {
+		c.sessions = map[peerKey]*collision{}
+	}
+	k := s.peerKey()
+	other, ok := c.sessions[k]
+	if !ok {
+		c.sessions[k] = &collision{s: s}
+		return nil
+	}
+	if other.established || other.s.Inbound == s.Inbound {
+		return s
+	}
+	// The connection initiated by us is closed when our identifier is lower, the one
+	// initiated by the peer otherwise.
+	local := binary.BigEndian.Uint32(s.BGPIdentifier.To4())
+	closeInbound := local > k.id
+	if local == k.id {
+		closeInbound = s.AS > s.state.AS
+	}
+	if other.s.Inbound != closeInbound {
+		return s
+	}
+	c.sessions[k] = &collision{s: s}
+	return other.s
+}
+
+// established marks s as established, new connections from its peer will be closed.
+func (c *Collisions) established(s *Session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.sessions[s.peerKey()]; ok && e.s == s {
+		e.established = true
+	}
+}
+
+// remove removes s when it ends.
+func (c *Collisions) remove(s *Session) {
+	if s.state.BGPIdentifier == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := s.peerKey()
+	if e, ok := c.sessions[k]; ok && e.s == s {
+		delete(c.sessions, k)
+	}
+}
+
+// resolveCollision checks s for a collision. If another session loses it is closed,
+// if s loses the error that closed it is returned.
+func (s *Session) resolveCollision() error {
+	if s.Collisions == nil {
+		return nil
+	}
+	loser := s.Collisions.resolve(s)
+	if loser == nil {
+		return nil
+	}
+	err := loser.notify(NewError(6, 7, ""))
+	if loser == s {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package bgp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCollisionResolve(t *testing.T) {
+	peer := State{BGPIdentifier: net.IPv4(10, 0, 0, 2)}
+	for _, tc := range []struct {
+		local   net.IP
+		loseOut bool // The outbound connection loses.
+	}{
+		{net.IPv4(10, 0, 0, 1), true},
+		{net.IPv4(10, 0, 0, 3), false},
+	} {
+		c := &Collisions{}
+		out := &Session{BGPIdentifier: tc.local, state: peer}
+		in := &Session{BGPIdentifier: tc.local, state: peer, Inbound: true}
+		if loser := c.resolve(out); loser != nil {
+			t.Fatalf("expected no collision, got %v", loser)
+		}
+		loser := c.resolve(in)
+		if (loser == out) != tc.loseOut || loser == nil {
+			t.Errorf("local %s: wrong connection closed, outbound: %t", tc.local, loser == out)
+		}
+
+		// An established session wins from a new connection.
+		c = &Collisions{}
+		c.resolve(in)
+		c.established(in)
+		if loser := c.resolve(out); loser != out {
+			t.Errorf("local %s: expected new connection to be closed", tc.local)
+		}
+	}
+}
+
+func TestCollisionSameIdentifier(t *testing.T) {
+	id := net.IPv4(10, 0, 0, 1)
+	for _, tc := range []struct {
+		as      uint32
+		loseOut bool
+	}{
+		{65000, true},
+		{65002, false},
+	} {
+		peer := State{AS: 65001, BGPIdentifier: id}
+		c := &Collisions{}
+		out := &Session{AS: tc.as, BGPIdentifier: id, state: peer}
+		in := &Session{AS: tc.as, BGPIdentifier: id, state: peer, Inbound: true}
+		c.resolve(out)
+		if loser := c.resolve(in); loser == nil || (loser == out) != tc.loseOut {
+			t.Errorf("AS %d: wrong connection closed, outbound: %t", tc.as, loser == out)
+		}
+
+		// Another peer with the same identifier in a different AS does not collide.
+		other := &Session{AS: tc.as, BGPIdentifier: id, state: State{AS: 65003, BGPIdentifier: id}, Inbound: true}
+		if loser := c.resolve(other); loser != nil {
+			t.Errorf("AS %d: expected no collision with another AS", tc.as)
+		}
+	}
+}
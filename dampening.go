@@ -0,0 +1,243 @@
+package bgp
+
+// Route flap dampening, RFC 2439.
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHalfLife        = 15 * time.Minute
+	defaultMaxSuppressTime = 60 * time.Minute
+	defaultSuppress        = 2000
+	defaultReuse           = 750
+
+	withdrawPenalty   = 1000 // Penalty for a withdrawal.
+	attributesPenalty = 500  // Penalty for a change of the attributes of a route.
+)
+
+// Dampening suppresses unstable prefixes received from peers, see AdjRIBIn.Dampening.
+// Every withdrawal and every change of the attributes of a route adds to the penalty of
+// its prefix, which decays exponentially. When the penalty exceeds Suppress, the
+// routes for the prefix are withheld from the Loc-RIB until it decays below Reuse.
+// The state is kept per peer, so the Adj-RIB-Ins sharing a Dampening must have
+// different Peers. Fields left zero use the defaults in parentheses.
+type Dampening struct {
+	HalfLife time.Duration // Time for the penalty to decay to half (15m).
+	Suppress int           // Penalty from which a prefix is suppressed (2000).
+	Reuse    int           // Penalty below which a suppressed prefix is reused (750).
+	// MaxSuppressTime limits the time a prefix is suppressed after its last flap, by
+	// capping the penalty (60m).
+	MaxSuppressTime time.Duration
+	Clock           Clock
+
+	mu     sync.Mutex
+	states map[dampKey]*flap
+}
+
+// dampKey identifies the dampening state of a prefix received from a peer.
+type dampKey struct {
+	peer   *Peer
+	family Family
+	prefix string
+}
+
+// DampState is the dampening state of a prefix.
+type DampState struct {
+	Penalty    int
+	Flaps      int
+	Suppressed bool
+	Reuse      time.Time // Time the prefix is reused, if it is suppressed.
+}
+
+// flap is the dampening state of a prefix. The timer runs until the prefix is reused,
+// or until the penalty is low enough to forget the prefix.
+type flap struct {
+	prefix     Prefix
+	penalty    float64
+	updated    time.Time
+	flaps      int
+	suppressed bool
+	reuseAt    time.Time
+	timer      Timer
+	reuse      func() // Called when the prefix is reused.
+}
+
+// State returns the dampening state of prefix p in family f received from peer, or
+// false if p is not dampened.
+func (d *Dampening) State(peer *Peer, f Family, p Prefix) (DampState, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fl := d.states[dampKey{peer, f, p.String()}]
+	if fl == nil {
+		return DampState{}, false
+	}
+	d.decay(fl)
+	return DampState{Penalty: int(fl.penalty), Flaps: fl.flaps, Suppressed: fl.suppressed, Reuse: fl.reuseAt}, true
+}
+
+// Walk calls fn for every dampened prefix in family f and the peer it was received
+// from, until fn returns false. The order is not defined. Fn must not call methods of d.
+func (d *Dampening) Walk(f Family, fn func(*Peer, Prefix, DampState) bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, fl := range d.states {
+		if key.family != f {
+			continue
+		}
+		d.decay(fl)
+		if !fn(key.peer, fl.prefix, DampState{Penalty: int(fl.penalty), Flaps: fl.flaps, Suppressed: fl.suppressed, Reuse: fl.reuseAt}) {
+			return
+		}
+	}
+}
+
+// Reset forgets the dampening state of prefix p in family f received from peer,
+// reusing it if it was suppressed.
+func (d *Dampening) Reset(peer *Peer, f Family, p Prefix) {
+	d.mu.Lock()
+	fl := d.forget(dampKey{peer, f, p.String()})
+	d.mu.Unlock()
+	if fl != nil && fl.suppressed {
+		fl.reuse()
+	}
+}
+
+// suppressed returns true if prefix p in family f received from peer is suppressed.
+func (d *Dampening) suppressed(peer *Peer, f Family, p Prefix) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fl := d.states[dampKey{peer, f, p.String()}]
+	return fl != nil && fl.suppressed
+}
+
+// penalize adds penalty to prefix p in family f received from peer. Reuse is called,
+// without holding d.mu, when p is reused after having been suppressed.
+func (d *Dampening) penalize(peer *Peer, f Family, p Prefix, penalty int, reuse func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.states == nil {
+		d.states = map[dampKey]*flap{}
+	}
+	key := dampKey{peer, f, p.String()}
+	fl := d.states[key]
+	if fl == nil {
+		fl = &flap{prefix: p, updated: d.clock().Now()}
+		d.states[key] = fl
+	}
+	d.decay(fl)
+	fl.reuse = reuse
+	fl.flaps++
+	fl.penalty = math.Min(fl.penalty+float64(penalty), d.ceiling())
+	if fl.penalty >= float64(d.suppress()) {
+		fl.suppressed = true
+	}
+	if fl.timer == nil {
+		fl.timer = d.clock().AfterFunc(d.next(fl), func() { d.expire(key, fl) })
+		return
+	}
+	fl.timer.Reset(d.next(fl))
+}
+
+// expire is called by the timer of fl, to reuse or to forget the prefix.
+func (d *Dampening) expire(key dampKey, fl *flap) {
+	d.mu.Lock()
+	if d.states[key] != fl {
+		d.mu.Unlock()
+		return
+	}
+	d.decay(fl)
+	if fl.suppressed && !d.clock().Now().Before(fl.reuseAt) {
+		fl.suppressed = false
+		fl.timer.Reset(d.next(fl))
+		d.mu.Unlock()
+		fl.reuse()
+		return
+	}
+	if !fl.suppressed && fl.penalty < float64(d.reuse())/2+1 {
+		d.forget(key)
+	} else {
+		fl.timer.Reset(d.next(fl))
+	}
+	d.mu.Unlock()
+}
+
+// forget removes the state of the prefix with key and returns it.
+func (d *Dampening) forget(key dampKey) *flap {
+	fl := d.states[key]
+	if fl == nil {
+		return nil
+	}
+	fl.timer.Stop()
+	delete(d.states, key)
+	return fl
+}
+
+// decay updates the penalty of fl to the current time.
+func (d *Dampening) decay(fl *flap) {
+	now := d.clock().Now()
+	fl.penalty *= math.Exp2(-float64(now.Sub(fl.updated)) / float64(d.halfLife()))
+	fl.updated = now
+}
+
+// next returns the time until the next event of fl: the reuse of a suppressed prefix,
+// or the decay of the penalty to half the reuse threshold, when fl can be forgotten.
+// It also sets the reuse time of a suppressed prefix.
+func (d *Dampening) next(fl *flap) time.Duration {
+	threshold := float64(d.reuse())
+	if !fl.suppressed {
+		threshold /= 2
+	}
+	var t time.Duration
+	if fl.penalty > threshold {
+		t = time.Duration(math.Ceil(math.Log2(fl.penalty/threshold) * float64(d.halfLife())))
+	}
+	fl.reuseAt = time.Time{}
+	if fl.suppressed {
+		fl.reuseAt = fl.updated.Add(t)
+	}
+	return t
+}
+
+// ceiling returns the maximum penalty, which decays to the reuse threshold in
+// MaxSuppressTime.
+func (d *Dampening) ceiling() float64 {
+	return float64(d.reuse()) * math.Exp2(float64(d.maxSuppressTime())/float64(d.halfLife()))
+}
+
+func (d *Dampening) halfLife() time.Duration {
+	if d.HalfLife == 0 {
+		return defaultHalfLife
+	}
+	return d.HalfLife
+}
+
+func (d *Dampening) maxSuppressTime() time.Duration {
+	if d.MaxSuppressTime == 0 {
+		return defaultMaxSuppressTime
+	}
+	return d.MaxSuppressTime
+}
+
+func (d *Dampening) suppress() int {
+	if d.Suppress == 0 {
+		return defaultSuppress
+	}
+	return d.Suppress
+}
+
+func (d *Dampening) reuse() int {
+	if d.Reuse == 0 {
+		return defaultReuse
+	}
+	return d.Reuse
+}
+
+func (d *Dampening) clock() Clock {
+	if d.Clock == nil {
+		return systemClock{}
+	}
+	return d.Clock
+}
@@ -0,0 +1,104 @@
+package bgp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDampening(t *testing.T) {
+	c := &fakeClock{now: time.Unix(0, 0)}
+	l := &LocRIB{}
+	d := &Dampening{Clock: c}
+	r := &AdjRIBIn{LocRIB: l, Peer: &Peer{AS: 65001, LocalAS: 65000}, Dampening: d}
+	p := prefix("10.0.0.0/16")
+	route := func() *Route { return &Route{Prefix: p, NextHop: net.IPv4(192, 0, 2, 1)} }
+
+	r.Add(ipv4Unicast, route())
+	r.Add(ipv4Unicast, route())
+	if _, ok := d.State(r.Peer, ipv4Unicast, p); ok {
+		t.Fatalf("unexpected penalty for an unchanged route")
+	}
+	r.Remove(ipv4Unicast, p, 0)
+	r.Add(ipv4Unicast, route())
+	if s, _ := d.State(r.Peer, ipv4Unicast, p); s.Penalty != 1000 || s.Suppressed {
+		t.Fatalf("unexpected state after one flap: %+v", s)
+	}
+	c.Advance(15 * time.Minute)
+	r.Remove(ipv4Unicast, p, 0)
+	r.Add(ipv4Unicast, route())
+	r.Add(ipv4Unicast, &Route{Prefix: p, NextHop: net.IPv4(192, 0, 2, 2)})
+	r.Remove(ipv4Unicast, p, 0)
+	r.Add(ipv4Unicast, route())
+	s, _ := d.State(r.Peer, ipv4Unicast, p)
+	if s.Penalty != 3000 || s.Flaps != 4 || !s.Suppressed {
+		t.Fatalf("expected suppressed prefix, got %+v", s)
+	}
+	if l.Best(ipv4Unicast, p) != nil {
+		t.Fatalf("suppressed prefix in the Loc-RIB")
+	}
+	if rs := r.Lookup(PostPolicy, ipv4Unicast, p); len(rs) != 1 {
+		t.Fatalf("expected the suppressed route in the Adj-RIB-In")
+	}
+
+	// 3000 decays to 750 in two half-lives.
+	if want := c.Now().Add(30 * time.Minute); !s.Reuse.Equal(want) {
+		t.Fatalf("expected reuse at %s, got %s", want, s.Reuse)
+	}
+	c.Advance(29 * time.Minute)
+	if l.Best(ipv4Unicast, p) != nil {
+		t.Fatalf("prefix reused too early")
+	}
+	c.Advance(time.Minute)
+	if l.Best(ipv4Unicast, p) == nil {
+		t.Fatalf("expected prefix to be reused")
+	}
+	c.Advance(time.Hour)
+	if _, ok := d.State(r.Peer, ipv4Unicast, p); ok {
+		t.Fatalf("expected dampening state to be forgotten")
+	}
+
+	// The penalty is capped so a prefix is suppressed no longer than MaxSuppressTime.
+	for i := 0; i < 20; i++ {
+		r.Remove(ipv4Unicast, p, 0)
+		r.Add(ipv4Unicast, route())
+	}
+	if s, _ := d.State(r.Peer, ipv4Unicast, p); !s.Reuse.Equal(c.Now().Add(time.Hour)) {
+		t.Fatalf("expected reuse after the maximum suppress time, got %s", s.Reuse.Sub(c.Now()))
+	}
+	d.Reset(r.Peer, ipv4Unicast, p)
+	if l.Best(ipv4Unicast, p) == nil {
+		t.Fatalf("expected prefix to be reused after reset")
+	}
+}
+
+func TestDampeningPeers(t *testing.T) {
+	c := &fakeClock{now: time.Unix(0, 0)}
+	l := &LocRIB{}
+	d := &Dampening{Clock: c}
+	r1 := &AdjRIBIn{LocRIB: l, Peer: &Peer{AS: 65001, LocalAS: 65000}, Dampening: d}
+	r2 := &AdjRIBIn{LocRIB: l, Peer: &Peer{AS: 65002, LocalAS: 65000}, Dampening: d}
+	p := prefix("10.0.0.0/16")
+	route := func() *Route { return &Route{Prefix: p, NextHop: net.IPv4(192, 0, 2, 1)} }
+
+	r2.Add(ipv4Unicast, route())
+	for i := 0; i < 3; i++ {
+		r1.Add(ipv4Unicast, route())
+		r1.Remove(ipv4Unicast, p, 0)
+	}
+	r1.Add(ipv4Unicast, route())
+	if s, _ := d.State(r1.Peer, ipv4Unicast, p); !s.Suppressed {
+		t.Fatalf("expected prefix from the flapping peer to be suppressed, got %+v", s)
+	}
+	if _, ok := d.State(r2.Peer, ipv4Unicast, p); ok {
+		t.Fatal("unexpected dampening state for the stable peer")
+	}
+	if best := l.Best(ipv4Unicast, p); best == nil || best.Peer != r2.Peer {
+		t.Fatalf("expected the route of the stable peer to be used, got %+v", best)
+	}
+	n := 0
+	d.Walk(ipv4Unicast, func(peer *Peer, _ Prefix, _ DampState) bool { n++; return peer == r1.Peer })
+	if n != 1 {
+		t.Fatalf("expected 1 dampened prefix, got %d", n)
+	}
+}
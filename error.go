@@ -1,17 +1,25 @@
 package bgp
 
-import "strconv"
+import (
+	"strconv"
+	"strings"
+)
 
 // Error is an error the BGP protocol can return.
 type Error struct {
 	Code    int    // Code as defined in RFC 4271.
 	Subcode int    // Subcode as defined in RFC 4271.
 	Err     string // Non mandatory extra text added by this package.
+	// Data holds the data that is sent in the NOTIFICATION for this error, this is
+	// usually (part of) the offending message, see RFC 4271, Section 6.
+	Data []byte
+
+	wrapped *Error // The error carried in a Hard Reset, RFC 8538.
 }
 
 // NewError returns a pointer to an Error.
 func NewError(code, subcode int, extra string) *Error {
-	return &Error{code, subcode, extra}
+	return &Error{Code: code, Subcode: subcode, Err: extra}
 }
 
 func (e *Error) Error() string {
@@ -21,32 +29,127 @@ func (e *Error) Error() string {
 	} else {
 		s += strconv.Itoa(e.Code)
 	}
-	s += ": "
 
-	v := strconv.Itoa(e.Subcode)
-	switch e.Code {
-	case 1:
-		if _, ok := errorSubcodesHeader[e.Subcode]; ok {
-			v = errorSubcodesHeader[e.Subcode]
-		}
-	case 2:
-		if _, ok := errorSubcodesOpen[e.Subcode]; ok {
-			v = errorSubcodesOpen[e.Subcode]
-		}
-	case 3:
-		if _, ok := errorSubcodesUpdate[e.Subcode]; ok {
-			v = errorSubcodesUpdate[e.Subcode]
+	if e.Subcode != 0 || (e.Code != 4 && e.Code != 8) {
+		v := strconv.Itoa(e.Subcode)
+		if sub, ok := errorSubcodes[e.Code][e.Subcode]; ok {
+			v = sub
 		}
+		s += ": " + v
 	}
-	s += v
 	if e.Err != "" {
 		s += ": " + e.Err
 	}
 	return s
 }
 
+// Is reports whether target is an *Error with the same code and subcode as e. A target
+// with subcode 0 matches all errors with its code, so errors.Is(err, ErrCease)
+// is true for every Cease.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	return t.Code == e.Code && (t.Subcode == 0 || t.Subcode == e.Subcode)
+}
+
+// Unwrap returns the error carried by a Hard Reset, or nil.
+func (e *Error) Unwrap() error {
+	if e.wrapped == nil {
+		return nil
+	}
+	return e.wrapped
+}
+
+// notification returns the NOTIFICATION that should be sent for e.
+func (e *Error) notification() *Notification {
+	return &Notification{ErrorCode: uint8(e.Code), ErrorSubcode: uint8(e.Subcode), Data: e.Data}
+}
+
+// notificationError returns the error for the NOTIFICATION n received from a peer.
+func notificationError(n *Notification) *Error {
+	e := n.error()
+	if e.Err == "" {
+		e.Err = "received from peer"
+	} else {
+		e.Err = "received from peer: " + e.Err
+	}
+	return e
+}
+
+// error returns the error carried by m. A Hard Reset wraps the error of the
+// NOTIFICATION in its data, RFC 8538, Section 3.
+func (m *Notification) error() *Error {
+	e := NewError(int(m.ErrorCode), int(m.ErrorSubcode), "")
+	e.Data = m.Data
+	if m.Communication != "" {
+		e.Err = "shutdown communication " + strconv.Quote(m.Communication)
+	}
+	if e.Is(ErrHardReset) && len(m.Data) >= 2 {
+		inner := &Notification{ErrorCode: m.Data[0], ErrorSubcode: m.Data[1], Data: m.Data[2:]}
+		inner.setCommunication()
+		e.wrapped = inner.error()
+		e.Err = strings.TrimPrefix(e.wrapped.Error(), "bgp: ")
+	}
+	return e
+}
+
 var errBuf = &Error{Err: "buffer size too small"}
 
+// Errors for all codes and subcodes, to be used with errors.Is. The errors for a
+// code (ErrHeader, ErrOpen, etc.) match all subcodes of that code.
+var (
+	ErrHeader        = &Error{Code: 1}
+	ErrOpen          = &Error{Code: 2}
+	ErrUpdate        = &Error{Code: 3}
+	ErrHoldTimer     = &Error{Code: 4}
+	ErrFSM           = &Error{Code: 5}
+	ErrCease         = &Error{Code: 6}
+	ErrRouteRefresh  = &Error{Code: 7}
+	ErrSendHoldTimer = &Error{Code: 8}
+
+	ErrConnectionNotSynchronized = &Error{Code: 1, Subcode: 1}
+	ErrBadMessageLength          = &Error{Code: 1, Subcode: 2}
+	ErrBadMessageType            = &Error{Code: 1, Subcode: 3}
+
+	ErrUnsupportedVersion           = &Error{Code: 2, Subcode: 1}
+	ErrBadPeerAS                    = &Error{Code: 2, Subcode: 2}
+	ErrBadBGPIdentifier             = &Error{Code: 2, Subcode: 3}
+	ErrUnsupportedOptionalParameter = &Error{Code: 2, Subcode: 4}
+	ErrUnacceptableHoldTime         = &Error{Code: 2, Subcode: 6}
+	ErrUnsupportedCapability        = &Error{Code: 2, Subcode: 7}
+	ErrRoleMismatch                 = &Error{Code: 2, Subcode: 11}
+
+	ErrMalformedAttributeList         = &Error{Code: 3, Subcode: 1}
+	ErrUnrecognizedWellKnownAttribute = &Error{Code: 3, Subcode: 2}
+	ErrMissingWellKnownAttribute      = &Error{Code: 3, Subcode: 3}
+	ErrAttributeFlags                 = &Error{Code: 3, Subcode: 4}
+	ErrAttributeLength                = &Error{Code: 3, Subcode: 5}
+	ErrInvalidOrigin                  = &Error{Code: 3, Subcode: 6}
+	ErrInvalidNextHop                 = &Error{Code: 3, Subcode: 8}
+	ErrOptionalAttribute              = &Error{Code: 3, Subcode: 9}
+	ErrInvalidNetworkField            = &Error{Code: 3, Subcode: 10}
+	ErrMalformedASPath                = &Error{Code: 3, Subcode: 11}
+
+	ErrUnexpectedInOpenSent    = &Error{Code: 5, Subcode: 1}
+	ErrUnexpectedInOpenConfirm = &Error{Code: 5, Subcode: 2}
+	ErrUnexpectedInEstablished = &Error{Code: 5, Subcode: 3}
+
+	ErrMaxPrefixes         = &Error{Code: 6, Subcode: 1}
+	ErrAdminShutdown       = &Error{Code: 6, Subcode: 2}
+	ErrPeerDeconfigured    = &Error{Code: 6, Subcode: 3}
+	ErrAdminReset          = &Error{Code: 6, Subcode: 4}
+	ErrConnectionRejected  = &Error{Code: 6, Subcode: 5}
+	ErrOtherConfigChange   = &Error{Code: 6, Subcode: 6}
+	ErrConnectionCollision = &Error{Code: 6, Subcode: 7}
+	ErrOutOfResources      = &Error{Code: 6, Subcode: 8}
+	ErrHardReset           = &Error{Code: 6, Subcode: 9}
+	ErrBFDDown             = &Error{Code: 6, Subcode: 10}
+
+	ErrInvalidRefreshLength = &Error{Code: 7, Subcode: 1}
+)
+
 var errorCodes = map[int]string{
 	1: "message header error",
 	2: "OPEN message error",
@@ -54,6 +157,17 @@ var errorCodes = map[int]string{
 	4: "hold timer expired",
 	5: "finite state machine error",
 	6: "cease",
+	7: "ROUTE-REFRESH message error",
+	8: "send hold timer expired", // RFC 9687
+}
+
+var errorSubcodes = map[int]map[int]string{
+	1: errorSubcodesHeader,
+	2: errorSubcodesOpen,
+	3: errorSubcodesUpdate,
+	5: errorSubcodesFSM,
+	6: errorSubcodesCease,
+	7: errorSubcodesRouteRefresh,
 }
 
 var errorSubcodesHeader = map[int]string{
@@ -70,6 +184,8 @@ var errorSubcodesOpen = map[int]string{
 	// 5 deprecated
 	6: "unacceptable hold time",
 	7: "unsupported capability",
+	// 8-10 deprecated
+	11: "role mismatch",
 }
 
 var errorSubcodesUpdate = map[int]string{
@@ -85,3 +201,30 @@ var errorSubcodesUpdate = map[int]string{
 	10: "invalid network field",
 	11: "malformed AS_PATH",
 }
+
+// RFC 6608
+var errorSubcodesFSM = map[int]string{
+	0: "unspecified error",
+	1: "receive unexpected message in OpenSent state",
+	2: "receive unexpected message in OpenConfirm state",
+	3: "receive unexpected message in Established state",
+}
+
+// RFC 4486, RFC 8538 and RFC 9384
+var errorSubcodesCease = map[int]string{
+	1:  "maximum number of prefixes reached",
+	2:  "administrative shutdown",
+	3:  "peer de-configured",
+	4:  "administrative reset",
+	5:  "connection rejected",
+	6:  "other configuration change",
+	7:  "connection collision resolution",
+	8:  "out of resources",
+	9:  "hard reset",
+	10: "BFD down",
+}
+
+// RFC 7313
+var errorSubcodesRouteRefresh = map[int]string{
+	1: "invalid message length",
+}
@@ -0,0 +1,35 @@
+package bgp
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestErrorIs(t *testing.T) {
+	buf := []byte{0, 0, 0, 4, FlagTransitive, origin, 1, 9}
+	buf = append((&header{Length: headerLen + uint16(len(buf)), Type: update}).bytes(), buf...)
+	_, _, err := setBytes(buf)
+
+	if !errors.Is(err, ErrInvalidOrigin) || !errors.Is(err, ErrUpdate) {
+		t.Fatalf("expected invalid origin error, got %v", err)
+	}
+	if errors.Is(err, ErrMalformedASPath) || errors.Is(err, ErrCease) {
+		t.Fatalf("error matches wrong sentinel: %v", err)
+	}
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Fatalf("expected *Error in %v", err)
+	}
+	// The data holds the complete offending attribute.
+	if len(e.Data) != 4 || e.Data[1] != origin || e.Data[3] != 9 {
+		t.Fatalf("unexpected data: %v", e.Data)
+	}
+
+	n := &Notification{ErrorCode: 6, ErrorSubcode: 7}
+	if !errors.Is(notificationError(n), ErrConnectionCollision) {
+		t.Fatalf("expected connection collision")
+	}
+	if s := notificationError(n).Error(); s != "bgp: cease: connection collision resolution: received from peer" {
+		t.Fatalf("unexpected error string: %s", s)
+	}
+}
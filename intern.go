@@ -0,0 +1,76 @@
+package bgp
+
+import (
+	"sync"
+)
+
+// AttrTable interns attribute sets: byte-identical sets of path attributes are stored
+// once and shared by all routes that have them. The sets are reference counted and
+// removed when no route uses them anymore. An AttrTable can be used from multiple
+// goroutines and by multiple Adj-RIB-Ins.
+type AttrTable struct {
+	mu   sync.Mutex
+	sets map[string]*attrSet
+	refs map[*Attribute]*attrSet // Keyed by the first attribute of the interned slice.
+}
+
+type attrSet struct {
+	key   string
+	attrs []Attribute
+	refs  int
+}
+
+// Intern returns the interned set that is byte-identical to attrs, and adds a reference
+// to it. Attrs itself is interned if there is no such set yet. The returned slice
+// must not be modified.
+func (t *AttrTable) Intern(attrs []Attribute) []Attribute {
+	if len(attrs) == 0 {
+		return attrs
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sets == nil {
+		t.sets = map[string]*attrSet{}
+		t.refs = map[*Attribute]*attrSet{}
+	}
+	if s, ok := t.refs[&attrs[0]]; ok && len(s.attrs) == len(attrs) {
+		s.refs++
+		return s.attrs
+	}
+	var key []byte
+	for i := range attrs {
+		key = append(key, attrs[i].Bytes()...)
+	}
+	s := t.sets[string(key)]
+	if s == nil {
+		s = &attrSet{key: string(key), attrs: attrs[:len(attrs):len(attrs)]}
+		t.sets[s.key] = s
+		t.refs[&s.attrs[0]] = s
+	}
+	s.refs++
+	return s.attrs
+}
+
+// Release removes a reference to the interned set attrs.
+func (t *AttrTable) Release(attrs []Attribute) {
+	if len(attrs) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.refs[&attrs[0]]
+	if !ok {
+		return
+	}
+	if s.refs--; s.refs == 0 {
+		delete(t.sets, s.key)
+		delete(t.refs, &s.attrs[0])
+	}
+}
+
+// Len returns the number of interned sets.
+func (t *AttrTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.sets)
+}
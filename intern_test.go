@@ -0,0 +1,53 @@
+package bgp
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAttrTable(t *testing.T) {
+	rt := testRoute(0, 65001)
+	u := &Update{Attributes: append(rt.Attributes, Attribute{})}
+	nh := NextHop(rt.NextHop)
+	u.Attributes[3].Append(next_hop, &nh)
+	for i := 0; i < 100; i++ {
+		u.ReachabilityInfo = append(u.ReachabilityInfo, prefix(fmt.Sprintf("10.%d.0.0/16", i)))
+	}
+	buf := u.bytes()
+
+	attrs := &AttrTable{}
+	ribs := []*AdjRIBIn{{Attrs: attrs}, {Attrs: attrs}}
+	for _, r := range ribs {
+		// Decode for every peer, so the attributes are not shared to begin with.
+		m, _, err := setBytes(buf)
+		if err != nil {
+			t.Fatalf("failed to decode UPDATE: %s", err)
+		}
+		r.Apply(m.(*Update))
+	}
+	if attrs.Len() != 1 {
+		t.Fatalf("expected 1 interned set, got %d", attrs.Len())
+	}
+	a := ribs[0].Lookup(PrePolicy, ipv4Unicast, prefix("10.1.0.0/16"))[0]
+	b := ribs[1].Lookup(PrePolicy, ipv4Unicast, prefix("10.99.0.0/16"))[0]
+	if &a.Attributes[0] != &b.Attributes[0] {
+		t.Fatalf("expected routes to share their attributes")
+	}
+	// Encoding shared attributes does not write to them, run with -race.
+	shared := testRoute(0, 65001).Attributes
+	done := make(chan bool)
+	for i := 0; i < 2; i++ {
+		go func() { shared[1].Bytes(); done <- true }()
+	}
+	<-done
+	<-done
+	if shared[1].Length != 0 {
+		t.Fatalf("encoding set the attribute length: %d", shared[1].Length)
+	}
+
+	ribs[0].Clear()
+	ribs[1].Apply(&Update{WithdrawnRoutes: u.ReachabilityInfo})
+	if attrs.Len() != 0 {
+		t.Fatalf("expected no interned sets, got %d", attrs.Len())
+	}
+}
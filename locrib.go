@@ -0,0 +1,454 @@
+package bgp
+
+// Loc-RIB and the decision process, RFC 4271, Section 9.1.
+
+import (
+	"net"
+	"slices"
+	"sync"
+)
+
+// Peer identifies the peer a route was received from, for the decision process.
+type Peer struct {
+	Address       net.IP
+	AS            uint32 // AS of the peer.
+	LocalAS       uint32 // Our AS in the session with the peer, the same as AS for iBGP.
+	BGPIdentifier net.IP
+}
+
+// Peer returns the Peer for an established session.
+func (s *Session) Peer() *Peer {
+	p := &Peer{AS: s.state.AS, LocalAS: s.AS, BGPIdentifier: s.state.BGPIdentifier}
+	if addr, ok := s.conn.RemoteAddr().(*net.TCPAddr); ok {
+		p.Address = addr.IP
+	}
+	return p
+}
+
+func (p *Peer) ibgp() bool { return p.AS == p.LocalAS }
+
+// PeerRoute is a route together with the peer it was received from.
+type PeerRoute struct {
+	*Route
+	Peer *Peer
+}
+
+// Change is the change of the best path or the multipath set of a prefix. Old or New
+// is nil when the prefix had or has no best path.
+type Change struct {
+	Family   Family
+	Prefix   Prefix
+	Old, New *PeerRoute
+	// Paths holds the new multipath set, best path first, see LocRIB.MaxPaths.
+	Paths []*PeerRoute
+}
+
+// LocRIB holds the candidate routes for each prefix from all Adj-RIB-Ins that have it
+// set, and the best path selected from them by the decision process.
+type LocRIB struct {
+	// AlwaysCompareMED compares the MULTI_EXIT_DISC of routes from different neighbor ASes.
+	AlwaysCompareMED bool
+	// DeterministicMED selects the best route for each neighbor AS first, and then
+	// the best of those, so the result does not depend on the order in which the routes
+	// were received.
+	DeterministicMED bool
+	// MaxPaths is the maximum number of paths in the multipath set of a prefix: the
+	// best path and the routes that are equally good up to and including the IGP cost.
+	// If zero, only the best path is used.
+	MaxPaths int
+	// MultipathRelax allows routes with a different AS_PATH of the same length in the
+	// multipath set, otherwise the AS_PATH must be the same as that of the best path.
+	MultipathRelax bool
+	// Resolver, if not nil, resolves the next hops of the routes, the cost is used
+	// as the IGP cost. Next hops it cannot resolve are resolved recursively through
+	// the Loc-RIB. Routes with a next hop that is not resolved are not considered.
+	// After setting Resolver, call Recompute.
+	Resolver NextHopResolver
+	// OnChange, if not nil, is called for every change of a best path. It must not
+	// call methods of the LocRIB.
+	OnChange func(Change)
+
+	mu       sync.RWMutex
+	dests    map[Family]*Trie[*dest]
+	nexthops Trie[*nexthop]
+}
+
+// dest holds the candidate routes for a prefix, in the order they were received.
+type dest struct {
+	family Family
+	prefix Prefix
+	routes []*PeerRoute
+	best   *PeerRoute
+	paths  []*PeerRoute
+}
+
+// dest returns the dest for prefix p in family f, or nil.
+func (l *LocRIB) dest(f Family, p Prefix) *dest {
+	if t := l.dests[f]; t != nil {
+		d, _ := t.Get(p)
+		return d
+	}
+	return nil
+}
+
+// Best returns the best path for prefix p in family f, or nil.
+func (l *LocRIB) Best(f Family, p Prefix) *PeerRoute {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if d := l.dest(f, p); d != nil {
+		return d.best
+	}
+	return nil
+}
+
+// LongestMatch returns the best path of the most specific prefix that covers p, p
+// included, or nil. Use a host prefix to look up an address.
+func (l *LocRIB) LongestMatch(f Family, p Prefix) *PeerRoute {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var best *PeerRoute
+	if t := l.dests[f]; t != nil {
+		t.LessSpecifics(p, func(_ Prefix, d *dest) bool {
+			if d.best != nil {
+				best = d.best
+			}
+			return true
+		})
+	}
+	return best
+}
+
+// MoreSpecifics calls fn for the best path of every prefix covered by p, p included,
+// in prefix order, until fn returns false. Fn must not call methods of the LocRIB.
+func (l *LocRIB) MoreSpecifics(f Family, p Prefix, fn func(*PeerRoute) bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if t := l.dests[f]; t != nil {
+		t.MoreSpecifics(p, func(_ Prefix, d *dest) bool { return d.best == nil || fn(d.best) })
+	}
+}
+
+// Multipath returns the multipath set for prefix p in family f, best path first.
+func (l *LocRIB) Multipath(f Family, p Prefix) []*PeerRoute {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if d := l.dest(f, p); d != nil {
+		return append([]*PeerRoute(nil), d.paths...)
+	}
+	return nil
+}
+
+// Candidates returns all routes for prefix p in family f.
+func (l *LocRIB) Candidates(f Family, p Prefix) []*PeerRoute {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if d := l.dest(f, p); d != nil {
+		return append([]*PeerRoute(nil), d.routes...)
+	}
+	return nil
+}
+
+// Walk calls fn for the best path of every prefix in family f in prefix order, until
+// fn returns false. Fn must not call methods of the LocRIB.
+func (l *LocRIB) Walk(f Family, fn func(*PeerRoute) bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if t := l.dests[f]; t != nil {
+		t.Walk(func(_ Prefix, d *dest) bool { return d.best == nil || fn(d.best) })
+	}
+}
+
+// Count returns the number of prefixes with a best path in family f.
+func (l *LocRIB) Count(f Family) int {
+	n := 0
+	l.Walk(f, func(*PeerRoute) bool { n++; return true })
+	return n
+}
+
+// Recompute resolves all next hops again and runs the decision process for all
+// prefixes, as needed after Resolver is set or when many IGP costs changed.
+func (l *LocRIB) Recompute() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.retrack()
+	var changed []Prefix
+	for _, t := range l.dests {
+		t.Walk(func(_ Prefix, d *dest) bool {
+			if l.decide(d) && d.unicast() {
+				changed = append(changed, d.prefix)
+			}
+			return true
+		})
+	}
+	l.resolveCovered(changed...)
+}
+
+// set sets the routes from peer for prefix p in family f and runs the decision process.
+func (l *LocRIB) set(peer *Peer, f Family, p Prefix, routes []*Route) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.dests == nil {
+		l.dests = map[Family]*Trie[*dest]{}
+	}
+	t := l.dests[f]
+	if t == nil {
+		t = &Trie[*dest]{}
+		l.dests[f] = t
+	}
+	d, _ := t.Get(p)
+	if d == nil {
+		if len(routes) == 0 {
+			return
+		}
+		d = &dest{family: f, prefix: p}
+		t.Insert(p, d)
+	}
+
+	var old []*PeerRoute
+	prs := d.routes[:0]
+	for _, pr := range d.routes {
+		if pr.Peer == peer {
+			old = append(old, pr)
+		}
+		if pr.Peer != peer {
+			prs = append(prs, pr)
+			continue
+		}
+		// Keep the position of routes that did not change.
+		for i, rt := range routes {
+			if rt == pr.Route {
+				prs = append(prs, pr)
+				routes = append(routes[:i:i], routes[i+1:]...)
+				break
+			}
+		}
+	}
+	for _, rt := range routes {
+		prs = append(prs, &PeerRoute{rt, peer})
+		l.track(d, rt.NextHop)
+	}
+	for _, pr := range old {
+		if !slices.Contains(prs, pr) {
+			l.untrack(d, pr.NextHop)
+		}
+	}
+	d.routes = prs
+	if l.decide(d) && d.unicast() {
+		// Next hops may resolve through d.
+		l.resolveCovered(d.prefix)
+	}
+	if len(d.routes) == 0 {
+		t.Delete(p)
+	}
+}
+
+// decide selects the best path and the multipath set of d and reports the change. It
+// returns true if the best path changed.
+func (l *LocRIB) decide(d *dest) bool {
+	old, oldPaths := d.best, d.paths
+	d.best = l.best(d.routes)
+	d.paths = l.multipath(d.routes, d.best)
+	if (old != d.best || !slices.Equal(oldPaths, d.paths)) && l.OnChange != nil {
+		l.OnChange(Change{Family: d.family, Prefix: d.prefix, Old: old, New: d.best, Paths: d.paths})
+	}
+	return old != d.best
+}
+
+// unicast returns true if next hops may resolve through d.
+func (d *dest) unicast() bool {
+	return d.family == ipv4Unicast || d.family == (Family{AFI_IP6, SAFI_UNICAST})
+}
+
+// multipath returns best and the routes that are as good as best, up to MaxPaths.
+func (l *LocRIB) multipath(routes []*PeerRoute, best *PeerRoute) []*PeerRoute {
+	if best == nil {
+		return nil
+	}
+	paths := []*PeerRoute{best}
+	if l.MaxPaths <= 1 {
+		return paths
+	}
+	for _, pr := range routes {
+		if pr == best || l.compareCost(pr, best) != 0 {
+			continue
+		}
+		if _, ok := l.cost(pr); !ok {
+			continue
+		}
+		if !l.MultipathRelax && !slices.EqualFunc(pr.path(), best.path(), func(a, b AsPath) bool {
+			return a.Type == b.Type && slices.Equal(a.AS, b.AS)
+		}) {
+			continue
+		}
+		paths = append(paths, pr)
+	}
+	slices.SortStableFunc(paths[1:], l.compare)
+	if len(paths) > l.MaxPaths {
+		paths = paths[:l.MaxPaths]
+	}
+	return paths
+}
+
+// best returns the best route of routes, or nil if none is eligible.
+func (l *LocRIB) best(routes []*PeerRoute) *PeerRoute {
+	var eligible []*PeerRoute
+	for _, pr := range routes {
+		if _, ok := l.cost(pr); ok {
+			eligible = append(eligible, pr)
+		}
+	}
+	if !l.DeterministicMED {
+		return l.fold(eligible)
+	}
+	var (
+		order  []uint32
+		groups = map[uint32][]*PeerRoute{}
+	)
+	for _, pr := range eligible {
+		as := pr.neighborAS()
+		if _, ok := groups[as]; !ok {
+			order = append(order, as)
+		}
+		groups[as] = append(groups[as], pr)
+	}
+	var winners []*PeerRoute
+	for _, as := range order {
+		winners = append(winners, l.fold(groups[as]))
+	}
+	return l.fold(winners)
+}
+
+func (l *LocRIB) fold(routes []*PeerRoute) *PeerRoute {
+	var best *PeerRoute
+	for _, pr := range routes {
+		if best == nil || l.compare(pr, best) < 0 {
+			best = pr
+		}
+	}
+	return best
+}
+
+// cost returns the IGP cost of the next hop of pr, or false if it is not resolved.
+func (l *LocRIB) cost(pr *PeerRoute) (uint32, bool) {
+	if l.Resolver == nil || pr.NextHop == nil {
+		return 0, true
+	}
+	if n, _ := l.nexthops.Get(hostPrefix(pr.NextHop)); n != nil {
+		return n.res.cost, n.res.ok
+	}
+	return 0, false
+}
+
+// compare returns a negative number when a is preferred over b, and a positive number
+// when b is preferred, following RFC 4271, Section 9.1.2.2.
+func (l *LocRIB) compare(a, b *PeerRoute) int {
+	if c := l.compareCost(a, b); c != 0 {
+		return c
+	}
+	if c := compareIP(a.Peer.BGPIdentifier.To4(), b.Peer.BGPIdentifier.To4()); c != 0 {
+		return c
+	}
+	if c := compareIP(a.Peer.Address.To16(), b.Peer.Address.To16()); c != 0 {
+		return c
+	}
+	return cmp(a.PathID, b.PathID)
+}
+
+// compareCost is compare up to and including the IGP cost, the steps that decide
+// whether routes are equally good for multipath.
+func (l *LocRIB) compareCost(a, b *PeerRoute) int {
+	if x, y := a.localPref(), b.localPref(); x != y {
+		return cmp(y, x)
+	}
+	if x, y := a.pathLen(), b.pathLen(); x != y {
+		return cmp(x, y)
+	}
+	if x, y := a.origin(), b.origin(); x != y {
+		return cmp(x, y)
+	}
+	if l.AlwaysCompareMED || a.neighborAS() == b.neighborAS() {
+		if x, y := a.med(), b.med(); x != y {
+			return cmp(x, y)
+		}
+	}
+	if x, y := a.Peer.ibgp(), b.Peer.ibgp(); x != y {
+		if x {
+			return 1
+		}
+		return -1
+	}
+	x, _ := l.cost(a)
+	y, _ := l.cost(b)
+	return cmp(x, y)
+}
+
+func compareIP(a, b net.IP) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return cmp(a[i], b[i])
+		}
+	}
+	return cmp(len(a), len(b))
+}
+
+func cmp[T uint8 | uint32 | int](x, y T) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// localPref returns LOCAL_PREF, or 100 if the route does not have it.
+func (r *Route) localPref() uint32 {
+	if a := findAttr(r.Attributes, local_pref); a != nil {
+		return uint32(*a.Value().(*LocalPref))
+	}
+	return 100
+}
+
+// pathLen returns the length of AS_PATH, an AS_SET counts as one.
+func (r *Route) pathLen() int {
+	n := 0
+	for _, s := range r.path() {
+		if s.Type == AS_SET {
+			n++
+			continue
+		}
+		n += len(s.AS)
+	}
+	return n
+}
+
+// origin returns ORIGIN, or INCOMPLETE if the route does not have it.
+func (r *Route) origin() uint8 {
+	if a := findAttr(r.Attributes, origin); a != nil {
+		return uint8(*a.Value().(*Origin))
+	}
+	return INCOMPLETE
+}
+
+// med returns MULTI_EXIT_DISC, or 0 if the route does not have it.
+func (r *Route) med() uint32 {
+	if a := findAttr(r.Attributes, multi_exit_disc); a != nil {
+		return uint32(*a.Value().(*MultiExitDisc))
+	}
+	return 0
+}
+
+// neighborAS returns the first AS in AS_PATH, or 0 for a route from our own AS.
+func (r *Route) neighborAS() uint32 {
+	if p := r.path(); len(p) > 0 && p[0].Type == AS_SEQUENCE && len(p[0].AS) > 0 {
+		return p[0].AS[0]
+	}
+	return 0
+}
+
+func (r *Route) path() Path {
+	if a := findAttr(r.Attributes, path); a != nil {
+		return *a.Value().(*Path)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package bgp
+
+import (
+	"net"
+	"testing"
+)
+
+// testRoute returns a route for 10.0.0.0/8 with the AS path as and the MED med.
+func testRoute(med uint32, as ...uint32) *Route {
+	attrs := make([]Attribute, 3)
+	o, m := Origin(IGP), MultiExitDisc(med)
+	attrs[0].Append(origin, &o)
+	attrs[1].Append(path, &Path{{Type: AS_SEQUENCE, AS: as}})
+	attrs[2].Append(multi_exit_disc, &m)
+	return &Route{Prefix: prefix("10.0.0.0/8"), NextHop: net.IPv4(192, 0, 2, 1), Attributes: attrs}
+}
+
+func TestLocRIBDecision(t *testing.T) {
+	ipv4 := Family{AFI_IP, SAFI_UNICAST}
+	var changes []Change
+	l := &LocRIB{OnChange: func(c Change) { changes = append(changes, c) }}
+	peers := make([]*Peer, 3)
+	ribs := make([]*AdjRIBIn, 3)
+	for i := range peers {
+		peers[i] = &Peer{Address: net.IPv4(192, 0, 2, byte(i+1)), AS: 65001 + uint32(i), LocalAS: 65000,
+			BGPIdentifier: net.IPv4(10, 0, 0, byte(i+1))}
+		ribs[i] = &AdjRIBIn{LocRIB: l, Peer: peers[i]}
+	}
+	peers[2].AS = 65000 // iBGP
+
+	ribs[0].Add(ipv4, testRoute(0, 65001, 65010))
+	ribs[1].Add(ipv4, testRoute(0, 65002))
+	if b := l.Best(ipv4, prefix("10.0.0.0/8")); b == nil || b.Peer != peers[1] {
+		t.Fatalf("expected shortest AS path to win, got %+v", b)
+	}
+	if len(changes) != 2 || changes[1].Old == nil || changes[1].New.Peer != peers[1] {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+
+	// Equal path length: eBGP over iBGP.
+	ribs[2].Add(ipv4, testRoute(0, 65003))
+	if b := l.Best(ipv4, prefix("10.0.0.0/8")); b.Peer != peers[1] {
+		t.Fatalf("expected eBGP to win, got %v", b.Peer.Address)
+	}
+
+	// MED is only compared between routes from the same neighbor AS.
+	ribs[1].Add(ipv4, testRoute(50, 65002))
+	ribs[0].Add(ipv4, testRoute(10, 65002))
+	if b := l.Best(ipv4, prefix("10.0.0.0/8")); b.Peer != peers[0] {
+		t.Fatalf("expected lowest MED to win, got %v", b.Peer.Address)
+	}
+
+	// An unreachable next hop is not considered.
+	l.Resolver = ResolverFunc(func(nh net.IP) (uint32, bool) { return 0, false })
+	l.Recompute()
+	if b := l.Best(ipv4, prefix("10.0.0.0/8")); b != nil {
+		t.Fatalf("expected no best path, got %v", b.Peer.Address)
+	}
+	if c := changes[len(changes)-1]; c.New != nil {
+		t.Fatalf("expected withdrawal of the best path, got %+v", c)
+	}
+	l.Resolver = nil
+	l.Recompute()
+
+	for _, r := range ribs {
+		r.Clear()
+	}
+	if l.Count(ipv4) != 0 || len(l.Candidates(ipv4, prefix("10.0.0.0/8"))) != 0 {
+		t.Fatalf("expected empty Loc-RIB")
+	}
+}
+
+func TestLocRIBDeterministicMED(t *testing.T) {
+	// A (AS 1, MED 20), B (AS 2, MED 10) and C (AS 1, MED 10), with router IDs 1, 2 and 3.
+	// Compared in the order received, the result is C for A, B, C and A for C, B, A.
+	// Grouped per neighbor AS, C beats A and then B beats C on router ID.
+	ipv4 := Family{AFI_IP, SAFI_UNICAST}
+	routes := []*Route{testRoute(20, 1), testRoute(10, 2), testRoute(10, 1)}
+	for _, order := range [][]int{{0, 1, 2}, {2, 1, 0}} {
+		l := &LocRIB{DeterministicMED: true}
+		for _, i := range order {
+			p := &Peer{Address: net.IPv4(192, 0, 2, byte(i+1)), AS: 65001, LocalAS: 65000, BGPIdentifier: net.IPv4(10, 0, 0, byte(i+1))}
+			l.set(p, ipv4, routes[i].Prefix, []*Route{routes[i]})
+		}
+		if b := l.Best(ipv4, prefix("10.0.0.0/8")); b.Route != routes[1] {
+			t.Errorf("order %v: unexpected best path: AS %d, MED %d", order, b.neighborAS(), b.med())
+		}
+	}
+}
+
+func TestLocRIBMultipath(t *testing.T) {
+	ipv4 := Family{AFI_IP, SAFI_UNICAST}
+	routes := []*Route{testRoute(0, 65002, 65010), testRoute(0, 65003, 65010), testRoute(0, 65002, 65010), testRoute(0, 65004)}
+	for _, tc := range []struct {
+		maxPaths int
+		relax    bool
+		paths    int
+	}{
+		{0, false, 1},
+		{4, false, 2},
+		{4, true, 3},
+		{2, true, 2},
+	} {
+		var last Change
+		l := &LocRIB{MaxPaths: tc.maxPaths, MultipathRelax: tc.relax, OnChange: func(c Change) { last = c }}
+		// The shortest path is not from a peer, so it loses on LOCAL_PREF.
+		lp := LocalPref(50)
+		routes[3].Attributes = append(routes[3].Attributes[:3:3], Attribute{})
+		routes[3].Attributes[3].Append(local_pref, &lp)
+		for i, rt := range routes {
+			p := &Peer{Address: net.IPv4(192, 0, 2, byte(i+1)), AS: 65001, LocalAS: 65000, BGPIdentifier: net.IPv4(10, 0, 0, byte(i+1))}
+			l.set(p, ipv4, rt.Prefix, []*Route{rt})
+		}
+		paths := l.Multipath(ipv4, prefix("10.0.0.0/8"))
+		if len(paths) != tc.paths || paths[0].Route != routes[0] || len(last.Paths) != tc.paths {
+			t.Errorf("max paths %d, relax %t: expected %d paths, got %d", tc.maxPaths, tc.relax, tc.paths, len(paths))
+		}
+	}
+}
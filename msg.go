@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"unicode/utf8"
 )
 
 type header struct {
@@ -37,21 +38,54 @@ func (h *header) setBytes(buf []byte) (int, error) {
 // Prefix is used as the (Length, Prefix) tuple in Update messages.
 type Prefix net.IPNet
 
-func (p *Prefix) size() int     { _, bits := p.Mask.Size(); return bits }
-func (p *Prefix) bytes() []byte { return append([]byte{byte(p.size())}, p.IP...) }
+func (p *Prefix) String() string { return (*net.IPNet)(p).String() }
 
-func (p *Prefix) setBytes(buf []byte) (int, error) {
-	p.Mask = net.CIDRMask(int(buf[0]), int(buf[0]))
+func (p *Prefix) size() int { ones, _ := p.Mask.Size(); return ones }
 
-	for i := 0; i < int(p.size()/8); i++ {
-		p.IP[i] = buf[1+i]
+func (p *Prefix) bytes() []byte {
+	ip := p.IP.To4()
+	if ip == nil {
+		ip = p.IP.To16()
 	}
-	// now zero the last byte, otherwise there could be random crap in there.
-	if mod := p.size() % 8; mod != 0 {
-		// need to double check all this (and test!)
-		buf[2+mod] &= ^(0xFF >> uint(mod))
+	n := (p.size() + 7) / 8
+	return append([]byte{byte(p.size())}, ip[:n]...)
+}
+
+// setBytes sets the prefix from buf, bits is the length of an address in the
+// address family of the prefix, i.e. 32 or 128.
+func (p *Prefix) setBytes(buf []byte, bits int) (int, error) {
+	if len(buf) < 1 {
+		return 0, NewError(3, 10, "prefix length missing")
+	}
+	ones := int(buf[0])
+	if ones > bits {
+		return 0, NewError(3, 10, fmt.Sprintf("prefix length too large: %d > %d", ones, bits))
+	}
+	n := (ones + 7) / 8
+	if len(buf) < 1+n {
+		return 0, NewError(3, 10, fmt.Sprintf("prefix overruns buffer: %d < %d", len(buf), 1+n))
+	}
+	p.Mask = net.CIDRMask(ones, bits)
+	p.IP = make(net.IP, bits/8)
+	copy(p.IP, buf[1:1+n])
+	// Zero the bits beyond the prefix length, otherwise there could be random crap in there.
+	p.IP = p.IP.Mask(p.Mask)
+	return 1 + n, nil
+}
+
+// setPrefixes returns all prefixes encoded in buf, see Prefix.setBytes.
+func setPrefixes(buf []byte, bits int) ([]Prefix, error) {
+	var prefixes []Prefix
+	for i := 0; i < len(buf); {
+		p := Prefix{}
+		n, err := p.setBytes(buf[i:], bits)
+		if err != nil {
+			return nil, err
+		}
+		i += n
+		prefixes = append(prefixes, p)
 	}
-	return 1 + int(p.size()/8), nil
+	return prefixes, nil
 }
 
 func (m *Open) bytes() []byte {
@@ -66,8 +100,7 @@ func (m *Open) bytes() []byte {
 		binary.BigEndian.PutUint16(buf[1:], AS_TRANS)
 	}
 	binary.BigEndian.PutUint16(buf[3:], m.HoldTime)
-	buf[5], buf[6], buf[7], buf[8] =
-		m.BGPIdentifier[0], m.BGPIdentifier[1], m.BGPIdentifier[2], m.BGPIdentifier[3]
+	copy(buf[5:9], m.BGPIdentifier.To4())
 
 	pbuf := make([]byte, 0)
 	for _, p := range m.Parameters {
@@ -95,13 +128,15 @@ func (m *Open) setBytes(buf []byte) (int, error) {
 		return 0, NewError(2, 0, fmt.Sprintf("buffer size too small: %d < %d", len(buf), m.Length))
 	}
 
+	if m.Length < headerLen+10 {
+		return 0, NewError(1, 2, fmt.Sprintf("open too short: %d", m.Length))
+	}
+
 	buf = buf[offset:]
 	m.Version = buf[0]
 	m.AS = binary.BigEndian.Uint16(buf[1:])
 	m.HoldTime = binary.BigEndian.Uint16(buf[3:])
-	m.BGPIdentifier = net.IPv4(0, 0, 0, 0)
-	m.BGPIdentifier[0], m.BGPIdentifier[1], m.BGPIdentifier[2], m.BGPIdentifier[3] =
-		buf[5], buf[6], buf[7], buf[8]
+	m.BGPIdentifier = net.IPv4(buf[5], buf[6], buf[7], buf[8])
 
 	pLength := int(buf[9])
 	// offset = 10
@@ -123,6 +158,7 @@ func (m *Open) setBytes(buf []byte) (int, error) {
 }
 
 func (m *Keepalive) bytes() []byte {
+	m.header = &header{}
 	m.Length = headerLen
 	m.Type = keepalive
 
@@ -141,197 +177,224 @@ func (m *Keepalive) setBytes(buf []byte) (int, error) {
 	return offset, nil
 }
 
-/*
 func (m *Notification) bytes() []byte {
-	m.Length = uint16(m.Len())
-	m.Type = NOTIFICATION
-	header := m.header.Bytes()
-
-	buf := make([]byte, m.Len()-len(header))
-
-	offset := 0
-
-	buf[offset] = m.ErrorCode
-	offset++
+	data := m.Data
+	if m.Communication != "" && m.shutdown() {
+		data = appendString(nil, truncateUTF8(m.Communication, 255))
+	}
+	buf := append([]byte{m.ErrorCode, m.ErrorSubcode}, data...)
 
-	buf[offset] = m.ErrorSubcode
-	offset++
+	m.header = &header{}
+	m.Length = headerLen + uint16(len(buf))
+	m.Type = notification
 
-	copy(buf[offset:], m.Data)
+	header := m.header.bytes()
 	return append(header, buf...)
 }
 
 func (m *Notification) setBytes(buf []byte) (int, error) {
-	m.header = &header
-	offset, err := m.header.SetBytes(buf)
+	m.header = &header{}
+	offset, err := m.header.setBytes(buf)
 	if err != nil {
 		return offset, err
 	}
 
 	if len(buf) < int(m.Length) {
-		return 0, NewError(0, 0, fmt.Sprintf("buffer size too small: %d < %d", len(buf), m.Length))
+		return 0, NewError(1, 2, fmt.Sprintf("buffer size too small: %d < %d", len(buf), m.Length))
+	}
+	if m.Length < headerLen+2 {
+		return 0, NewError(1, 2, fmt.Sprintf("notification too short: %d", m.Length))
 	}
 
-	offset = 0
 	m.ErrorCode = buf[offset]
-	offset++
+	m.ErrorSubcode = buf[offset+1]
+	m.Data = append([]byte(nil), buf[offset+2:m.Length]...)
+	m.setCommunication()
+	return int(m.Length), nil
+}
 
-	m.ErrorSubcode = buf[offset]
-	offset++
+// setCommunication sets the shutdown communication from the data of m.
+func (m *Notification) setCommunication() {
+	if !m.shutdown() {
+		return
+	}
+	// An invalid communication is ignored, RFC 9003, Section 3.
+	if s, n := setString(m.Data); n > 0 && utf8.ValidString(s) {
+		m.Communication = s
+	}
+}
 
-	// TODO(miek): copy data until end of message
+// shutdown returns true if m is a Cease with subcode Administrative Shutdown or
+// Administrative Reset, these may carry a shutdown communication.
+func (m *Notification) shutdown() bool {
+	return m.ErrorCode == 6 && (m.ErrorSubcode == 2 || m.ErrorSubcode == 4)
+}
 
-	return offset, nil
+// truncateUTF8 truncates s to at most n bytes without splitting a UTF-8 sequence.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
 }
 
-func (m *Update) setBytes(buf []byte) (int, error) {
-	m.Length = uint16(m.Len())
-	m.Type = UPDATE
+func (m *RouteRefresh) bytes() []byte {
+	m.header = &header{}
+	m.Length = headerLen + 4
+	m.Type = routerefresh
 
-	offset := 0
-	n, err := m.header.SetBytes(buf[offset:])
+	header := m.header.bytes()
+	return append(header, byte(m.AFI>>8), byte(m.AFI), 0, m.SAFI)
+}
+
+func (m *RouteRefresh) setBytes(buf []byte) (int, error) {
+	m.header = &header{}
+	offset, err := m.header.setBytes(buf)
 	if err != nil {
 		return offset, err
 	}
-	offset += n
-
-	// withdrawnRoutesLength
-	wlengthOffset := offset
-	offset += 2
-
-	l := 0
-	for _, w := range m.WithdrawnRoutes {
-		n, err := w.pack(buf[offset:])
-		if err != nil {
-			return offset, err
-		}
-		l += w.len()
-		offset += n
+	if m.Length != headerLen+4 || len(buf) < headerLen+4 {
+		e := NewError(7, 1, fmt.Sprintf("length %d", m.Length))
+		e.Data = append([]byte(nil), buf...)
+		return 0, e
 	}
-	binary.BigEndian.PutUint16(buf[wlengthOffset:], uint16(l))
+	m.AFI = binary.BigEndian.Uint16(buf[offset:])
+	m.SAFI = buf[offset+3]
+	return int(m.Length), nil
+}
 
-	plengthOffset := offset
-	for _, p := range m.PathAttrs {
-		n, err := p.Pack(buf[offset:])
-		if err != nil {
-			return offset, err
-		}
-		l += p.Len()
-		offset += n
+func (m *Update) bytes() []byte {
+	w := appendPrefixes([]byte{}, m.WithdrawnRoutes, m.WithdrawnPathIDs)
+	a := []byte{}
+	for i := range m.Attributes {
+		a = append(a, m.Attributes[i].Bytes()...)
 	}
-	binary.BigEndian.PutUint16(buf[plengthOffset:], uint16(l))
 
-	for _, r := range m.ReachabilityInfo {
-		n, err := r.pack(buf[offset:])
-		if err != nil {
-			return offset, err
-		}
-		l += r.len()
-		offset += n
-	}
+	buf := make([]byte, 2, 4+len(w)+len(a))
+	binary.BigEndian.PutUint16(buf, uint16(len(w)))
+	buf = append(buf, w...)
+	buf = append(buf, 0, 0)
+	binary.BigEndian.PutUint16(buf[2+len(w):], uint16(len(a)))
+	buf = append(buf, a...)
+	buf = appendPrefixes(buf, m.ReachabilityInfo, m.PathIDs)
 
-	return offset, nil
+	m.header = &header{}
+	m.Length = headerLen + uint16(len(buf))
+	m.Type = update
+
+	header := m.header.bytes()
+	return append(header, buf...)
 }
 
-// Unpack converts wire format in buf to an UPDATE message.
-// Unpack returns the amount of bytes parsed or an error.
-func (m *Update) Unpack(buf []byte) (int, error) {
-	offset := 0
+// setBytes converts buf to an UPDATE message. Errors are handled as described in RFC 7606,
+// they are returned as an *UpdateError. If its Action is not SessionReset, m is still
+// usable and has been changed according to the Action.
+func (m *Update) setBytes(buf []byte) (int, error) { return m.decode(buf, nil) }
 
+// decode is setBytes, the NLRI of the families in addPath are decoded with path
+// identifiers.
+func (m *Update) decode(buf []byte, addPath map[Family]bool) (int, error) {
 	m.header = &header{}
-	offset, err := m.header.unpack(buf)
+	offset, err := m.header.setBytes(buf)
 	if err != nil {
 		return offset, err
 	}
 
-	if len(buf) < int(m.Length) {
-		return 0, NewError(3, 0, fmt.Sprintf("buffer size too small: %d < %d", len(buf), m.Length))
+	if len(buf) < int(m.Length) || m.Length < headerLen {
+		return 0, NewError(1, 2, fmt.Sprintf("buffer size too small: %d < %d", len(buf), m.Length))
 	}
+	buf = buf[offset:m.Length]
 
-	offset = 0
-
-	wLength := int(binary.BigEndian.Uint16(buf[offset:]))
-	offset += 2
-	if len(buf) < offset+wLength {
-		return offset, NewError(3, 0, fmt.Sprintf("buffer size too small: %d < %d", len(buf), offset+wLength))
+	ue := &UpdateError{}
+	if len(buf) < 2 {
+		return offset, ue.add(0, SessionReset, NewError(3, 1, "withdrawn routes length missing"))
 	}
-
-	i := 0
-	for i < wLength {
-		p := Prefix{}
-		n, e := p.unpack(buf[i+offset:])
-		if e != nil {
-			return offset, e
-		}
-		i += n
-		offset += n
-		m.WithdrawnRoutes = append(m.WithdrawnRoutes, p)
+	wLength := int(binary.BigEndian.Uint16(buf))
+	if len(buf) < 2+wLength+2 {
+		return offset, ue.add(0, SessionReset, NewError(3, 1, fmt.Sprintf("buffer size too small: %d < %d", len(buf), 2+wLength+2)))
 	}
-
-	pLength := int(binary.BigEndian.Uint16(buf[offset:]))
-	offset += 2
-	if len(buf) < offset+pLength {
-		return offset, NewError(3, 0, fmt.Sprintf("buffer size too small: %d < %d", len(buf), offset+pLength))
+	if m.WithdrawnRoutes, m.WithdrawnPathIDs, err = decodePrefixes(buf[2:2+wLength], 32, addPath[ipv4Unicast]); err != nil {
+		return offset, ue.add(0, SessionReset, err.(*Error))
 	}
+	buf = buf[2+wLength:]
 
-	i = 0
-	var (
-		p TLV
-		e error
-		n int
-	)
-	for i < pLength {
-		switch buf[i+offset+1] { //second byte has the type TODO(miek): should check if the access is valid
-		case ORIGIN:
-			p = new(Origin)
-			n, e = p.Unpack(buf[i+offset:])
-			if e != nil {
-				return offset, e
-			}
-		case AS_PATH:
-			p = new(AsPath)
-			n, e = p.Unpack(buf[i+offset:])
-			if e != nil {
-				return offset, e
+	pLength := int(binary.BigEndian.Uint16(buf))
+	if len(buf) < 2+pLength {
+		return offset, ue.add(0, SessionReset, NewError(3, 1, fmt.Sprintf("buffer size too small: %d < %d", len(buf), 2+pLength)))
+	}
+	attrs := buf[2 : 2+pLength]
+	seen := map[uint8]bool{}
+	for i := 0; i < len(attrs); {
+		a := Attribute{}
+		n, e := a.decode(attrs[i:], addPath)
+		if n == 0 {
+			// The attribute does not fit in the attribute list, we can still find
+			// the NLRI using the total attribute length, RFC 7606, Section 4. Not
+			// when the header is cut short or the attribute is MP_REACH_NLRI or
+			// MP_UNREACH_NLRI: routes of other families can't be found, Section 5.3.
+			hdr := 3
+			if attrs[i]&FlagLength == FlagLength {
+				hdr = 4
 			}
-		case COMMUNITIES:
-			p = new(Community)
-			n, e = p.Unpack(buf[i+offset:])
-			if e != nil {
-				return offset, e
+			if len(attrs[i:]) < hdr || a.Code == mp_reach_nlri || a.Code == mp_unreach_nlri {
+				return offset, ue.add(a.Code, SessionReset, e.(*Error))
 			}
-		default:
-			// unknown
+			ue.add(a.Code, TreatAsWithdraw, e.(*Error))
+			break
 		}
 		i += n
-		offset += n
-		m.PathAttrs = append(m.PathAttrs, p)
+		if seen[a.Code] {
+			if a.Code == mp_reach_nlri || a.Code == mp_unreach_nlri {
+				return offset, ue.add(a.Code, SessionReset, NewError(3, 1, fmt.Sprintf("duplicate attribute: %d", a.Code)))
+			}
+			ue.add(a.Code, AttributeDiscard, NewError(3, 1, fmt.Sprintf("duplicate attribute: %d", a.Code)))
+			continue
+		}
+		seen[a.Code] = true
+		if e != nil {
+			ue.attributeError(&a, e.(*Error))
+			continue
+		}
+		if a.Value() == nil {
+			continue
+		}
+		m.Attributes = append(m.Attributes, a)
 	}
 
-	rLength := int(m.Length) - offset
-	if len(buf) < offset+rLength {
-		return offset, NewError(3, 0, fmt.Sprintf("buffer size too small: %d < %d", len(buf), offset+rLength))
+	if m.ReachabilityInfo, m.PathIDs, err = decodePrefixes(buf[2+pLength:], 32, addPath[ipv4Unicast]); err != nil {
+		return offset, ue.add(0, SessionReset, err.(*Error))
 	}
 
-	i = 0
-	for i < rLength {
-		r := Prefix{}
-		n, e := r.unpack(buf[i+offset:])
-		if e != nil {
-			return offset, e
+	if len(m.ReachabilityInfo) > 0 || seen[mp_reach_nlri] {
+		for _, t := range []uint8{origin, path, next_hop} {
+			if t == next_hop && len(m.ReachabilityInfo) == 0 {
+				continue
+			}
+			if !seen[t] {
+				e := NewError(3, 3, fmt.Sprintf("attribute %d", t))
+				e.Data = []byte{t}
+				ue.add(t, TreatAsWithdraw, e)
+			}
 		}
-		i += n
-		offset += n
-		m.ReachabilityInfo = append(m.ReachabilityInfo, r)
 	}
-	return offset, nil
+	if err := ue.apply(m); err != nil {
+		return int(m.Length), err
+	}
+	return int(m.Length), nil
 }
-*/
 
 // setBytes converts the wire format in buf to a BGP message. The first parsed
 // message is returned together with the new offset in buf. If the parsing
-// fails an error is returned.
-func setBytes(buf []byte) (m Msg, n int, e error) {
+// fails an error is returned. For an UPDATE with errors that do not require
+// a session reset, both the message and an *UpdateError are returned.
+func setBytes(buf []byte) (m Msg, n int, e error) { return decode(buf, nil) }
+
+// decode is setBytes, the NLRI of the families in addPath are decoded with path
+// identifiers.
+func decode(buf []byte, addPath map[Family]bool) (m Msg, n int, e error) {
 	if len(buf) < headerLen {
 		return nil, 0, NewError(1, 2, fmt.Sprintf("pack: buffer size too small: %d < %d", len(buf), headerLen))
 	}
@@ -340,19 +403,27 @@ func setBytes(buf []byte) (m Msg, n int, e error) {
 	case open:
 		m = &Open{}
 		n, e = m.(*Open).setBytes(buf)
-		//	case update:
-		//		m = &Update{}
-		//		n, e = m.(*Update).SetBytes(buf)
+	case update:
+		m = &Update{}
+		n, e = m.(*Update).decode(buf, addPath)
 	case notification:
 		m = &Notification{}
 		n, e = m.(*Notification).setBytes(buf)
 	case keepalive:
 		m = &Keepalive{}
 		n, e = m.(*Keepalive).setBytes(buf)
+	case routerefresh:
+		m = &RouteRefresh{}
+		n, e = m.(*RouteRefresh).setBytes(buf)
 	default:
-		return nil, 0, NewError(1, 3, fmt.Sprintf("bad type: %d", buf[18]))
+		e := NewError(1, 3, fmt.Sprintf("bad type: %d", buf[18]))
+		e.Data = []byte{buf[18]}
+		return nil, 0, e
 	}
 	if e != nil {
+		if ue, ok := e.(*UpdateError); ok && ue.Action != SessionReset {
+			return m, n, e
+		}
 		return nil, n, e
 	}
 	return m, n, nil
@@ -363,12 +434,16 @@ func bytes(m Msg) []byte {
 	switch x := m.(type) {
 	case *Open:
 		return x.bytes()
-		//	case *Update:
-		//		return x.bytes()
+	case *Update:
+		return x.bytes()
 	case *Notification:
 		return x.bytes()
 	case *Keepalive:
 		return x.bytes()
+	case *RouteRefresh:
+		return x.bytes()
+	case encoded:
+		return x.bytes()
 	}
 	return nil
 }
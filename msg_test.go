@@ -1,7 +1,9 @@
 package bgp
 
 import (
+	"errors"
 	"net"
+	"strings"
 	"testing"
 )
 
@@ -19,7 +21,7 @@ var tests = []testCase{
 			Version:       4,
 			AS:            65000,
 			HoldTime:      240,
-			BGPIdentifier: net.ParseIP("b03a:7736::ffff:0:0"),
+			BGPIdentifier: net.IPv4(176, 58, 119, 54),
 			//Parameters:[{Type:2 data:[0x1842e0b0]}] header:0x1842e080}
 
 		},
@@ -40,8 +42,9 @@ func msgCompare(t *testing.T, te Msg, a Msg) {
 		if te.HoldTime != a.HoldTime {
 			t.Fatalf("open holdtime mismatch: expected %d, got %d", te.HoldTime, a.HoldTime)
 		}
-		t.Logf("%s\n", a.BGPIdentifier)
-		t.Logf("%s\n", te.BGPIdentifier)
+		if !te.BGPIdentifier.Equal(a.BGPIdentifier) {
+			t.Fatalf("open identifier mismatch: expected %s, got %s", te.BGPIdentifier, a.BGPIdentifier)
+		}
 	default:
 		t.Fatalf("unknown message type %T", typ)
 	}
@@ -59,3 +62,227 @@ func TestMsgsetBytes(t *testing.T) {
 		msgCompare(t, te.msg, m) // will Fatalf for us.
 	}
 }
+
+func TestOpenBytes(t *testing.T) {
+	o := &Open{Version: Version, AS: 65000, HoldTime: 90, BGPIdentifier: net.IPv4(192, 0, 2, 1)}
+	buf := bytes(o)
+	if id := buf[headerLen+5 : headerLen+9]; !net.IP(id).Equal(o.BGPIdentifier) {
+		t.Fatalf("identifier in wire format mismatch: got %v", id)
+	}
+	m, _, err := setBytes(buf)
+	if err != nil {
+		t.Fatalf("setBytes() failed: %s", err)
+	}
+	if id := m.(*Open).BGPIdentifier; id.To4() == nil || !id.Equal(o.BGPIdentifier) {
+		t.Fatalf("open identifier mismatch: expected %s, got %s", o.BGPIdentifier, id)
+	}
+}
+
+func TestUpdateBytes(t *testing.T) {
+	_, p1, _ := net.ParseCIDR("10.0.0.0/8")
+	_, p2, _ := net.ParseCIDR("192.168.1.128/25")
+	o := Origin(IGP)
+	otc := OnlyToCustomer(65000)
+	u := &Update{
+		WithdrawnRoutes:  []Prefix{Prefix(*p2)},
+		ReachabilityInfo: []Prefix{Prefix(*p1), Prefix(*p2)},
+		Attributes:       make([]Attribute, 4),
+	}
+	nh := NextHop(net.IPv4(10, 0, 0, 1))
+	u.Attributes[0].Append(origin, &o)
+	u.Attributes[1].Append(path, &Path{{Type: AS_SEQUENCE, AS: []uint32{65000, 4200000000}}})
+	u.Attributes[2].Append(next_hop, &nh)
+	u.Attributes[3].Append(only_to_customer, &otc)
+
+	buf := bytes(u)
+	m, n, err := setBytes(buf)
+	if err != nil {
+		t.Fatalf("setBytes() failed: %s", err)
+	}
+	if n != len(buf) {
+		t.Fatalf("parsed octets: expected %d, got %d", len(buf), n)
+	}
+	u1 := m.(*Update)
+	if len(u1.WithdrawnRoutes) != 1 || u1.WithdrawnRoutes[0].String() != "192.168.1.128/25" {
+		t.Fatalf("withdrawn routes mismatch: got %v", u1.WithdrawnRoutes)
+	}
+	if len(u1.ReachabilityInfo) != 2 || u1.ReachabilityInfo[0].String() != "10.0.0.0/8" {
+		t.Fatalf("reachability info mismatch: got %v", u1.ReachabilityInfo)
+	}
+	if len(u1.Attributes) != 4 {
+		t.Fatalf("expected 4 attributes, got %d", len(u1.Attributes))
+	}
+	p := *findAttr(u1.Attributes, path).Value().(*Path)
+	if len(p) != 1 || p[0].AS[1] != 4200000000 {
+		t.Fatalf("path mismatch: got %v", p)
+	}
+	a := findAttr(u1.Attributes, only_to_customer)
+	if a.Flags != FlagOptional|FlagTransitive || *a.Value().(*OnlyToCustomer) != 65000 {
+		t.Fatalf("otc mismatch: got %+v", a)
+	}
+}
+
+func TestNotificationBytes(t *testing.T) {
+	buf := bytes(&Notification{ErrorCode: 2, ErrorSubcode: 11, Data: []byte{1}})
+	m, _, err := setBytes(buf)
+	if err != nil {
+		t.Fatalf("setBytes() failed: %s", err)
+	}
+	n := m.(*Notification)
+	if n.ErrorCode != 2 || n.ErrorSubcode != 11 || len(n.Data) != 1 {
+		t.Fatalf("notification mismatch: got %+v", n)
+	}
+}
+
+func TestNotificationCommunication(t *testing.T) {
+	long := strings.Repeat("é", 200) // 400 bytes
+	buf := bytes(&Notification{ErrorCode: 6, ErrorSubcode: 2, Communication: long})
+	m, _, err := setBytes(buf)
+	if err != nil {
+		t.Fatalf("setBytes() failed: %s", err)
+	}
+	n := m.(*Notification)
+	if len(n.Communication) != 254 || n.Communication != long[:254] {
+		t.Fatalf("expected communication truncated to 254 bytes, got %d bytes", len(n.Communication))
+	}
+	e := notificationError(n)
+	if !strings.Contains(e.Error(), "administrative shutdown") || !strings.Contains(e.Error(), "éé") {
+		t.Fatalf("communication not in error: %s", e)
+	}
+
+	// Invalid UTF-8 is ignored.
+	buf = bytes(&Notification{ErrorCode: 6, ErrorSubcode: 4, Data: []byte{2, 0xff, 0xfe}})
+	m, _, _ = setBytes(buf)
+	if n := m.(*Notification); n.Communication != "" {
+		t.Fatalf("expected invalid communication to be ignored, got %q", n.Communication)
+	}
+}
+
+func TestUnknownPassThrough(t *testing.T) {
+	c := &Capability{}
+	if _, err := c.SetBytes([]byte{200, 2, 1, 2, CAP_AS4, 4, 0, 1, 0, 0}); err != nil {
+		t.Fatalf("SetBytes() failed: %s", err)
+	}
+	if v, ok := c.Get(200); !ok || len(v) != 2 {
+		t.Fatalf("unknown capability not kept: %v", c.data)
+	}
+	if v, ok := c.Get(CAP_AS4); !ok || v[1] != 1 {
+		t.Fatalf("capability after unknown capability not parsed: %v", c.data)
+	}
+
+	// Optional transitive 200, optional non-transitive 201.
+	buf := []byte{0, 0, 0, 8, FlagOptional | FlagTransitive, 200, 1, 42, FlagOptional, 201, 1, 43}
+	u := &Update{}
+	_, err := u.setBytes(append((&header{Length: headerLen + uint16(len(buf)), Type: update}).bytes(), buf...))
+	if err != nil {
+		t.Fatalf("setBytes() failed: %s", err)
+	}
+	if len(u.Attributes) != 1 || u.Attributes[0].Code != 200 || u.Attributes[0].Flags&FlagPartial == 0 {
+		t.Fatalf("expected partial attribute 200, got %+v", u.Attributes)
+	}
+	if b := u.Attributes[0].Bytes(); b[0]&FlagPartial == 0 || b[3] != 42 {
+		t.Fatalf("unknown attribute not passed on: %v", b)
+	}
+
+	buf[4] = FlagTransitive
+	_, err = u.setBytes(append((&header{Length: headerLen + uint16(len(buf)), Type: update}).bytes(), buf...))
+	if e, ok := err.(*UpdateError); !ok || e.Action != SessionReset || e.Errors[0].Err.Subcode != 2 {
+		t.Fatalf("expected unrecognized well-known attribute error, got %v", err)
+	}
+}
+
+func TestMalformedCapability(t *testing.T) {
+	for _, buf := range [][]byte{
+		{CAP_AS4, 2, 0, 1},
+		{CAP_ROUTE_REFRESH, 0, CAP_ROLE, 3, 1},
+	} {
+		_, err := (&Capability{}).SetBytes(buf)
+		e, ok := err.(*Error)
+		if !ok || e.Code != 2 || e.Subcode != 0 {
+			t.Fatalf("expected OPEN message error, got %v", err)
+		}
+		if len(e.Data) == 0 || e.Data[0] != buf[len(buf)-len(e.Data)] {
+			t.Fatalf("expected offending capability in data, got %x", e.Data)
+		}
+	}
+}
+
+func TestUpdateErrorHandling(t *testing.T) {
+	wellKnown := []byte{
+		FlagTransitive, origin, 1, IGP,
+		FlagTransitive, path, 0,
+		FlagTransitive, next_hop, 4, 10, 0, 0, 1,
+	}
+	tests := []struct {
+		attrs    []byte
+		action   Action
+		withdraw int
+		disabled int
+	}{
+		// AGGREGATOR with a bad length is discarded.
+		{append([]byte{FlagOptional | FlagTransitive, aggregator, 2, 0, 1}, wellKnown...), AttributeDiscard, 0, 0},
+		// Bad ORIGIN value.
+		{append([]byte{FlagTransitive, origin, 1, 7}, wellKnown[4:]...), TreatAsWithdraw, 1, 0},
+		// Missing NEXT_HOP.
+		{wellKnown[:7], TreatAsWithdraw, 1, 0},
+		// MULTI_EXIT_DISC with the wrong flags.
+		{append([]byte{FlagTransitive, multi_exit_disc, 4, 0, 0, 0, 1}, wellKnown...), TreatAsWithdraw, 1, 0},
+		// Bad next hop length in MP_REACH_NLRI for IPv6 unicast.
+		{append([]byte{FlagOptional, mp_reach_nlri, 7, 0, AFI_IP6, SAFI_UNICAST, 2, 0, 0, 0}, wellKnown...), AfiSafiDisable, 0, 1},
+		// Attribute overruns the attribute list, the NLRI can still be found.
+		{append(append([]byte{}, wellKnown...), FlagOptional, communities, 8, 0), TreatAsWithdraw, 1, 0},
+		// Truncated MP_REACH_NLRI, its routes can't be withdrawn.
+		{append(append([]byte{}, wellKnown...), FlagOptional, mp_reach_nlri, 30, 0, AFI_IP6, SAFI_UNICAST, 16), SessionReset, 0, 0},
+		// Attribute header cut short, its length can't be trusted.
+		{append(append([]byte{}, wellKnown...), FlagOptional|FlagLength, communities, 0), SessionReset, 0, 0},
+		// Duplicate MP_UNREACH_NLRI.
+		{append([]byte{FlagOptional, mp_unreach_nlri, 3, 0, AFI_IP6, SAFI_UNICAST, FlagOptional, mp_unreach_nlri, 3, 0, AFI_IP6, SAFI_UNICAST}, wellKnown...), SessionReset, 0, 0},
+	}
+	for i, te := range tests {
+		buf := []byte{0, 0, 0, byte(len(te.attrs))}
+		buf = append(buf, te.attrs...)
+		buf = append(buf, 8, 10) // 10.0.0.0/8
+		buf = append((&header{Length: headerLen + uint16(len(buf)), Type: update}).bytes(), buf...)
+
+		m, _, err := setBytes(buf)
+		e, ok := err.(*UpdateError)
+		if !ok {
+			t.Fatalf("test %d: expected *UpdateError, got %v", i, err)
+		}
+		if e.Action != te.action {
+			t.Fatalf("test %d: expected action %s, got %s", i, te.action, e.Action)
+		}
+		if len(e.Withdrawn) != te.withdraw || len(e.Disabled) != te.disabled {
+			t.Fatalf("test %d: expected %d withdrawn and %d disabled, got %+v", i, te.withdraw, te.disabled, e)
+		}
+		if te.action == SessionReset {
+			if m != nil {
+				t.Fatalf("test %d: expected no message on session reset", i)
+			}
+			continue
+		}
+		u := m.(*Update)
+		if te.withdraw > 0 && (len(u.ReachabilityInfo) != 0 || len(u.WithdrawnRoutes) != te.withdraw) {
+			t.Fatalf("test %d: expected routes to be withdrawn, got %+v", i, u)
+		}
+		if te.action == AttributeDiscard && (len(u.Attributes) != 3 || len(u.ReachabilityInfo) != 1) {
+			t.Fatalf("test %d: expected attribute to be discarded, got %+v", i, u)
+		}
+	}
+}
+
+func TestRouteRefreshBytes(t *testing.T) {
+	rr := &RouteRefresh{Family: Family{AFI_IP6, SAFI_UNICAST}}
+	m, n, err := setBytes(rr.bytes())
+	if err != nil || n != headerLen+4 {
+		t.Fatalf("failed to decode ROUTE-REFRESH: %v", err)
+	}
+	if m.(*RouteRefresh).Family != rr.Family {
+		t.Fatalf("expected %v, got %v", rr.Family, m.(*RouteRefresh).Family)
+	}
+	buf := append(rr.bytes(), 0)
+	buf[17]++
+	if _, _, err := setBytes(buf); !errors.Is(err, ErrInvalidRefreshLength) {
+		t.Fatalf("expected invalid message length, got %v", err)
+	}
+}
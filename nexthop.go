@@ -0,0 +1,260 @@
+package bgp
+
+// Next hop tracking and recursive resolution of BGP next hops, RFC 4271, Section 9.1.2.1.
+
+import (
+	"net"
+	"sync"
+)
+
+// maxRecursion is the maximum number of Loc-RIB routes a next hop may be resolved
+// through, it ends resolution loops.
+const maxRecursion = 8
+
+// maxChanges is the number of times the resolution of a next hop may change in one
+// call of resolveCovered. After that it is left unresolved, as its resolution does not
+// converge, for instance because it resolves through routes that use it.
+const maxChanges = 2 * maxRecursion
+
+// NextHopResolver resolves the next hops of routes for the decision process, usually
+// with the routing table of the IGP.
+type NextHopResolver interface {
+	// Resolve returns the cost to reach nh, or false if nh cannot be resolved.
+	Resolve(nh net.IP) (cost uint32, ok bool)
+}
+
+// ResolverFunc is a function that implements NextHopResolver.
+type ResolverFunc func(nh net.IP) (uint32, bool)
+
+func (f ResolverFunc) Resolve(nh net.IP) (uint32, bool) { return f(nh) }
+
+// StaticResolver resolves next hops with a table of prefixes and their costs, using the
+// most specific prefix that covers the next hop. The zero value resolves nothing.
+type StaticResolver struct {
+	// OnChange, if not nil, is called with the prefix that was set or deleted, to
+	// have it passed to LocRIB.NextHopsChanged.
+	OnChange func(Prefix)
+
+	mu    sync.RWMutex
+	costs Trie[uint32]
+}
+
+// Set sets the cost to reach the addresses in p.
+func (r *StaticResolver) Set(p Prefix, cost uint32) {
+	r.mu.Lock()
+	r.costs.Insert(p, cost)
+	r.mu.Unlock()
+	if r.OnChange != nil {
+		r.OnChange(p)
+	}
+}
+
+// Delete deletes p, the addresses in p are no longer reachable through it.
+func (r *StaticResolver) Delete(p Prefix) {
+	r.mu.Lock()
+	r.costs.Delete(p)
+	r.mu.Unlock()
+	if r.OnChange != nil {
+		r.OnChange(p)
+	}
+}
+
+func (r *StaticResolver) Resolve(nh net.IP) (uint32, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, cost, ok := r.costs.LongestMatch(hostPrefix(nh))
+	return cost, ok
+}
+
+// NextHopState is the state of a next hop tracked by the Loc-RIB.
+type NextHopState struct {
+	Address  net.IP
+	Resolved bool
+	Cost     uint32
+	// Via is the Loc-RIB prefix the next hop is resolved through, when it is not
+	// resolved by the resolver.
+	Via    *Prefix
+	Routes int // Number of routes with this next hop.
+}
+
+// nexthop is a next hop tracked by the Loc-RIB, with the dests that have routes using it.
+type nexthop struct {
+	addr  net.IP
+	res   resolution
+	dests map[*dest]int // Number of routes per dest.
+}
+
+// resolution is the result of resolving a next hop.
+type resolution struct {
+	ok    bool
+	cost  uint32
+	via   *dest // Set when resolved recursively.
+	depth int   // Number of Loc-RIB routes resolved through.
+}
+
+// NextHopState returns the state of the tracked next hop nh, or false if no route uses
+// it or the LocRIB has no Resolver.
+func (l *LocRIB) NextHopState(nh net.IP) (NextHopState, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	n, _ := l.nexthops.Get(hostPrefix(nh))
+	if n == nil {
+		return NextHopState{}, false
+	}
+	s := NextHopState{Address: n.addr, Resolved: n.res.ok, Cost: n.res.cost}
+	if n.res.via != nil {
+		via := n.res.via.prefix
+		s.Via = &via
+	}
+	for _, c := range n.dests {
+		s.Routes += c
+	}
+	return s, true
+}
+
+// NextHopsChanged resolves the tracked next hops in p again, and runs the decision
+// process for the prefixes with routes using the next hops that changed. Call it when
+// the reachability or the cost of p changes in the Resolver.
+func (l *LocRIB) NextHopsChanged(p Prefix) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.resolveCovered(p)
+}
+
+// track registers that a route in d uses next hop nh.
+func (l *LocRIB) track(d *dest, nh net.IP) {
+	if l.Resolver == nil || nh == nil {
+		return
+	}
+	p := hostPrefix(nh)
+	n, _ := l.nexthops.Get(p)
+	if n == nil {
+		n = &nexthop{addr: nh, dests: map[*dest]int{}}
+		l.nexthops.Insert(p, n)
+		n.res = l.resolve(n)
+	}
+	n.dests[d]++
+}
+
+// untrack reverses track, the next hop is forgotten when no route uses it.
+func (l *LocRIB) untrack(d *dest, nh net.IP) {
+	if nh == nil {
+		return
+	}
+	p := hostPrefix(nh)
+	n, _ := l.nexthops.Get(p)
+	if n == nil {
+		return
+	}
+	if n.dests[d]--; n.dests[d] <= 0 {
+		delete(n.dests, d)
+	}
+	if len(n.dests) == 0 {
+		l.nexthops.Delete(p)
+	}
+}
+
+// retrack tracks the next hops of all routes again, as needed after Resolver changed.
+func (l *LocRIB) retrack() {
+	l.nexthops = Trie[*nexthop]{}
+	for _, t := range l.dests {
+		t.Walk(func(_ Prefix, d *dest) bool {
+			for _, pr := range d.routes {
+				l.track(d, pr.NextHop)
+			}
+			return true
+		})
+	}
+}
+
+// resolve resolves n with the Resolver, or through the best path of the most specific
+// Loc-RIB prefix that covers it. A route is never used to resolve its own next hop.
+func (l *LocRIB) resolve(n *nexthop) resolution {
+	if cost, ok := l.Resolver.Resolve(n.addr); ok {
+		return resolution{ok: true, cost: cost}
+	}
+	f := Family{AFI_IP6, SAFI_UNICAST}
+	if n.addr.To4() != nil {
+		f = ipv4Unicast
+	}
+	t := l.dests[f]
+	if t == nil {
+		return resolution{}
+	}
+	var via *dest
+	t.LessSpecifics(hostPrefix(n.addr), func(_ Prefix, d *dest) bool {
+		if d.best != nil && !d.best.NextHop.Equal(n.addr) {
+			via = d
+		}
+		return true
+	})
+	if via == nil {
+		return resolution{}
+	}
+	r := resolution{ok: true, via: via, depth: 1}
+	if nh := via.best.NextHop; nh != nil {
+		vn, _ := l.nexthops.Get(hostPrefix(nh))
+		if vn == nil || !vn.res.ok || vn.res.depth >= maxRecursion {
+			return resolution{}
+		}
+		r.cost, r.depth = vn.res.cost, vn.res.depth+1
+	}
+	return r
+}
+
+// resolveCovered resolves the tracked next hops in prefixes again. For next hops that
+// changed the decision process runs for the dests using them, which may in turn change
+// the resolution of the next hops in those dests: their prefixes are added to the work
+// list, until nothing changes. As every next hop changes at most maxChanges+1 times,
+// this ends.
+func (l *LocRIB) resolveCovered(prefixes ...Prefix) {
+	if l.Resolver == nil {
+		return
+	}
+	var (
+		work    = prefixes
+		queued  = map[string]bool{}
+		changes = map[*nexthop]int{}
+	)
+	for _, p := range prefixes {
+		queued[p.String()] = true
+	}
+	for len(work) > 0 {
+		p := work[0]
+		work = work[1:]
+		delete(queued, p.String())
+
+		var changed []*nexthop
+		l.nexthops.MoreSpecifics(p, func(_ Prefix, n *nexthop) bool {
+			res := resolution{}
+			if changes[n] < maxChanges {
+				res = l.resolve(n)
+			}
+			if res != n.res {
+				n.res = res
+				changes[n]++
+				changed = append(changed, n)
+			}
+			return true
+		})
+		for _, n := range changed {
+			for d := range n.dests {
+				// Also when the best path stays, next hops resolved through it
+				// may have changed with n.
+				again := l.decide(d) || d.best != nil && d.best.NextHop.Equal(n.addr)
+				if again && d.unicast() && !queued[d.prefix.String()] {
+					queued[d.prefix.String()] = true
+					work = append(work, d.prefix)
+				}
+			}
+		}
+	}
+}
+
+// hostPrefix returns the /32 or /128 prefix of ip.
+func hostPrefix(ip net.IP) Prefix {
+	if ip4 := ip.To4(); ip4 != nil {
+		return Prefix{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return Prefix{IP: ip.To16(), Mask: net.CIDRMask(128, 128)}
+}
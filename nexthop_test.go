@@ -0,0 +1,146 @@
+package bgp
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func TestNextHopTracking(t *testing.T) {
+	r := &StaticResolver{}
+	var changes []Change
+	l := &LocRIB{Resolver: r, OnChange: func(c Change) { changes = append(changes, c) }}
+	r.OnChange = l.NextHopsChanged
+	ribs := make([]*AdjRIBIn, 2)
+	for i := range ribs {
+		peer := &Peer{Address: net.IPv4(192, 0, 2, byte(i+1)), AS: 65000, LocalAS: 65000, BGPIdentifier: net.IPv4(10, 0, 0, byte(i+1))}
+		ribs[i] = &AdjRIBIn{LocRIB: l, Peer: peer}
+	}
+	route := func(p string, nh net.IP) *Route {
+		rt := testRoute(0, 65010)
+		rt.Prefix, rt.NextHop = prefix(p), nh
+		return rt
+	}
+	nh1, nh2 := net.IPv4(192, 0, 2, 1), net.IPv4(198, 51, 100, 1)
+	r.Set(prefix("192.0.2.0/24"), 10)
+
+	ribs[0].Add(ipv4Unicast, route("10.0.0.0/8", nh1))
+	ribs[1].Add(ipv4Unicast, route("10.0.0.0/8", nh2))
+	if b := l.Best(ipv4Unicast, prefix("10.0.0.0/8")); b == nil || !b.NextHop.Equal(nh1) {
+		t.Fatalf("expected route with resolved next hop to win, got %+v", b)
+	}
+	if s, ok := l.NextHopState(nh2); !ok || s.Resolved || s.Routes != 1 {
+		t.Fatalf("expected unresolved next hop, got %+v", s)
+	}
+
+	// The next hop of the second route resolves recursively through a route to it.
+	ribs[0].Add(ipv4Unicast, route("198.51.100.0/24", nh1))
+	s, _ := l.NextHopState(nh2)
+	if !s.Resolved || s.Cost != 10 || s.Via == nil || s.Via.String() != "198.51.100.0/24" {
+		t.Fatalf("expected next hop resolved through 198.51.100.0/24, got %+v", s)
+	}
+	if len(l.Candidates(ipv4Unicast, prefix("10.0.0.0/8"))) != 2 || l.Best(ipv4Unicast, prefix("10.0.0.0/8")) == nil {
+		t.Fatalf("expected two candidates with a best path")
+	}
+
+	// A lower IGP cost wins.
+	r.Set(prefix("198.51.100.0/24"), 5)
+	if b := l.Best(ipv4Unicast, prefix("10.0.0.0/8")); b == nil || !b.NextHop.Equal(nh2) {
+		t.Fatalf("expected route with lower IGP cost to win, got %+v", b)
+	}
+	if c := changes[len(changes)-1]; c.Prefix.String() != "10.0.0.0/8" || !c.New.NextHop.Equal(nh2) {
+		t.Fatalf("expected change of the best path, got %+v", c)
+	}
+	r.Delete(prefix("198.51.100.0/24"))
+
+	// A route is not resolved through itself.
+	nh3 := net.IPv4(203, 0, 113, 1)
+	ribs[1].Add(ipv4Unicast, route("203.0.113.0/24", nh3))
+	if b := l.Best(ipv4Unicast, prefix("203.0.113.0/24")); b != nil {
+		t.Fatalf("expected route resolved through itself to be ignored, got %+v", b)
+	}
+
+	// Without 192.0.2.0/24 nothing resolves, also not recursively.
+	r.Delete(prefix("192.0.2.0/24"))
+	if n := l.Count(ipv4Unicast); n != 0 {
+		t.Fatalf("expected no best paths, got %d", n)
+	}
+	if s, _ := l.NextHopState(nh2); s.Resolved {
+		t.Fatalf("expected unresolved next hop, got %+v", s)
+	}
+
+	// Routes that resolve through each other are unresolved once the resolver no
+	// longer resolves their next hops.
+	r.Set(prefix("10.0.0.0/8"), 1)
+	ribs[0].Add(ipv4Unicast, route("10.1.0.0/16", net.IPv4(10, 2, 0, 1)))
+	ribs[0].Add(ipv4Unicast, route("10.2.0.0/16", net.IPv4(10, 1, 0, 1)))
+	if l.Best(ipv4Unicast, prefix("10.1.0.0/16")) == nil || l.Best(ipv4Unicast, prefix("10.2.0.0/16")) == nil {
+		t.Fatalf("expected best paths with resolved next hops")
+	}
+	r.Delete(prefix("10.0.0.0/8"))
+	if l.Best(ipv4Unicast, prefix("10.1.0.0/16")) != nil || l.Best(ipv4Unicast, prefix("10.2.0.0/16")) != nil {
+		t.Fatalf("expected resolution loop to be broken")
+	}
+
+	for _, rib := range ribs {
+		rib.Clear()
+	}
+	if _, ok := l.NextHopState(nh1); ok || l.nexthops.Len() != 0 {
+		t.Fatalf("expected no tracked next hops")
+	}
+}
+
+func TestNextHopResolutionRandom(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	r := &StaticResolver{}
+	l := &LocRIB{Resolver: r, MaxPaths: 2}
+	r.OnChange = l.NextHopsChanged
+	ribs := make([]*AdjRIBIn, 3)
+	for i := range ribs {
+		peer := &Peer{Address: net.IPv4(192, 0, 2, byte(i+1)), AS: 65000, LocalAS: 65000, BGPIdentifier: net.IPv4(10, 0, 0, byte(i+1))}
+		ribs[i] = &AdjRIBIn{LocRIB: l, Peer: peer}
+	}
+	// Prefixes and next hops are taken from the same small space, so next hops fall
+	// in the prefixes of other routes and resolve through each other.
+	randPrefix := func() Prefix {
+		switch rnd.Intn(3) {
+		case 0:
+			return prefix(fmt.Sprintf("10.%d.0.0/16", rnd.Intn(4)))
+		case 1:
+			return prefix(fmt.Sprintf("10.%d.%d.0/24", rnd.Intn(4), rnd.Intn(4)))
+		}
+		return prefix("10.0.0.0/8")
+	}
+	randNextHop := func() net.IP { return net.IPv4(10, byte(rnd.Intn(4)), byte(rnd.Intn(4)), 1) }
+
+	for i := 0; i < 5000; i++ {
+		rib := ribs[rnd.Intn(len(ribs))]
+		switch rnd.Intn(6) {
+		case 0, 1:
+			rt := testRoute(uint32(rnd.Intn(3)), 65010)
+			rt.Prefix, rt.NextHop = randPrefix(), randNextHop()
+			rib.Add(ipv4Unicast, rt)
+		case 2:
+			rib.Remove(ipv4Unicast, randPrefix(), 0)
+		case 3:
+			r.Set(randPrefix(), uint32(rnd.Intn(20)))
+		case 4:
+			r.Delete(randPrefix())
+		case 5:
+			if rnd.Intn(50) == 0 {
+				l.Recompute()
+			}
+		}
+	}
+
+	// Every prefix has the best path of its candidates.
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.dests[ipv4Unicast].Walk(func(p Prefix, d *dest) bool {
+		if best := l.best(d.routes); best != d.best {
+			t.Errorf("%s: best path %+v, expected %+v", p.String(), d.best, best)
+		}
+		return true
+	})
+}
@@ -0,0 +1,106 @@
+package bgp
+
+// Packing of routes into as few UPDATE messages as possible.
+
+// packUpdates returns the UPDATEs that withdraw withdrawn and announce routes in
+// family f. Routes with the same next hop and byte-identical attributes share UPDATEs
+// and no UPDATE is larger than size bytes. IPv4 unicast routes use the withdrawn routes
+// and NLRI fields, other families MP_UNREACH_NLRI and MP_REACH_NLRI. With addPath the
+// NLRI carry the path identifiers of the routes.
+func packUpdates(f Family, withdrawn, routes []*Route, size int, addPath bool) []*Update {
+	var ups []*Update
+	if len(withdrawn) > 0 {
+		ups = append(ups, pack(size, func() *Update { return withdraw(f, nil) }, withdrawn, addPath)...)
+	}
+
+	var (
+		order  []string
+		groups = map[string][]*Route{}
+	)
+	for _, rt := range routes {
+		key := attrKey(rt)
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], rt)
+	}
+	for _, key := range order {
+		group := groups[key]
+		ups = append(ups, pack(size, func() *Update { return announce(f, group[0]) }, group, addPath)...)
+	}
+	return ups
+}
+
+// pack adds the prefixes of routes to UPDATEs returned by empty, starting a new UPDATE
+// when the next prefix does not fit in size bytes.
+func pack(size int, empty func() *Update, routes []*Route, addPath bool) []*Update {
+	var ups []*Update
+	for len(routes) > 0 {
+		u := empty()
+		// One more byte for the extended length of MP_REACH_NLRI or MP_UNREACH_NLRI.
+		n := len(u.bytes()) + 1
+		i := 0
+		for ; i < len(routes); i++ {
+			l := 1 + (routes[i].Prefix.size()+7)/8
+			if addPath {
+				l += 4
+			}
+			if n+l > size && i > 0 {
+				break
+			}
+			n += l
+		}
+		addPrefixes(u, routes[:i], addPath)
+		ups = append(ups, u)
+		routes = routes[i:]
+	}
+	return ups
+}
+
+// addPrefixes adds the prefixes of routes to the routes announced or withdrawn by u,
+// with their path identifiers if addPath is true.
+func addPrefixes(u *Update, routes []*Route, addPath bool) {
+	prefixes := make([]Prefix, len(routes))
+	var ids []uint32
+	for i, rt := range routes {
+		prefixes[i] = rt.Prefix
+		if addPath {
+			ids = append(ids, rt.PathID)
+		}
+	}
+	for _, a := range u.Attributes {
+		switch v := a.Value().(type) {
+		case *MPReach:
+			v.NLRI, v.PathIDs = append(v.NLRI, prefixes...), appendPathIDs(v.PathIDs, ids)
+			return
+		case *MPUnreach:
+			v.WithdrawnRoutes, v.PathIDs = append(v.WithdrawnRoutes, prefixes...), appendPathIDs(v.PathIDs, ids)
+			return
+		}
+	}
+	if findAttr(u.Attributes, next_hop) != nil {
+		u.ReachabilityInfo, u.PathIDs = append(u.ReachabilityInfo, prefixes...), appendPathIDs(u.PathIDs, ids)
+		return
+	}
+	u.WithdrawnRoutes, u.WithdrawnPathIDs = append(u.WithdrawnRoutes, prefixes...), appendPathIDs(u.WithdrawnPathIDs, ids)
+}
+
+// appendPathIDs appends ids to to, it keeps to nil when ids is nil.
+func appendPathIDs(to, ids []uint32) []uint32 {
+	if ids == nil {
+		return to
+	}
+	return append(to, ids...)
+}
+
+// attrKey returns a key that is the same for routes with the same next hop and
+// attributes.
+func attrKey(rt *Route) string {
+	key := []byte(rt.NextHop.To16())
+	for i := range rt.Attributes {
+		if rt.Attributes[i].Code != next_hop {
+			key = append(key, rt.Attributes[i].Bytes()...)
+		}
+	}
+	return string(key)
+}
@@ -0,0 +1,55 @@
+package bgp
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPackUpdates(t *testing.T) {
+	ipv6 := Family{AFI_IP6, SAFI_UNICAST}
+	a, b := testRoute(0, 65001), testRoute(10, 65002)
+	var (
+		routes    []*Route
+		withdrawn []*Route
+	)
+	for i := 0; i < 2000; i++ {
+		rt := *a
+		if i%2 == 1 {
+			rt = *b
+		}
+		rt.Prefix = prefix(fmt.Sprintf("2001:db8:%x::/48", i))
+		routes = append(routes, &rt)
+		withdrawn = append(withdrawn, &Route{Prefix: prefix(fmt.Sprintf("2001:db9:%x::/48", i))})
+	}
+
+	for _, size := range []int{MaxSize, MaxExtendedSize} {
+		ups := packUpdates(ipv6, withdrawn, routes, size, false)
+		announced, unreached := 0, 0
+		for _, u := range ups {
+			buf := u.bytes()
+			if len(buf) > size {
+				t.Fatalf("UPDATE of %d bytes larger than %d", len(buf), size)
+			}
+			m, _, err := setBytes(buf)
+			if err != nil {
+				t.Fatalf("generated UPDATE does not decode: %s", err)
+			}
+			for _, a := range m.(*Update).Attributes {
+				switch v := a.Value().(type) {
+				case *MPReach:
+					announced += len(v.NLRI)
+				case *MPUnreach:
+					unreached += len(v.WithdrawnRoutes)
+				}
+			}
+		}
+		if announced != 2000 || unreached != 2000 {
+			t.Fatalf("expected 2000 announced and withdrawn prefixes, got %d and %d", announced, unreached)
+		}
+		// Each /48 takes 7 bytes: with the standard size the withdrawals need 4 UPDATEs
+		// and each group of 1000 routes 2.
+		if expect := map[int]int{MaxSize: 8, MaxExtendedSize: 3}[size]; len(ups) != expect {
+			t.Errorf("size %d: expected %d UPDATEs, got %d", size, expect, len(ups))
+		}
+	}
+}
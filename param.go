@@ -1,6 +1,9 @@
 package bgp
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"fmt"
+)
 
 // Parameter is used in the Open message to negotiate options.
 type Parameter struct {
@@ -22,29 +25,27 @@ func (p *Parameter) Bytes() []byte {
 }
 
 func (p *Parameter) SetBytes(buf []byte) (int, error) {
-	if len(buf) < 3 {
-		return 0, errBuf
+	if len(buf) < 2 {
+		return 0, NewError(2, 0, "parameter header too short")
 	}
 	p.Type = buf[0]
 	length := int(buf[1])
-	if len(buf) < length {
-		return 0, errBuf
+	if len(buf) < length+2 {
+		e := NewError(2, 0, fmt.Sprintf("parameter %d overruns optional parameters", p.Type))
+		e.Data = append([]byte(nil), buf...)
+		return 0, e
 	}
 	switch p.Type {
 	case CAP:
 		c := &Capability{}
-
-		i := 2
-		for i < length {
-			n, e := c.SetBytes(buf[i:])
-			if e != nil {
-				return i + n, e
-			}
-			i += n
+		if n, e := c.SetBytes(buf[2 : length+2]); e != nil {
+			return 2 + n, e
 		}
 		p.Append(CAP, c)
 	default:
-		println("bgp: unknown type", p.Type)
+		// Unknown parameter, keep it as is.
+		r := Raw(append([]byte(nil), buf[2:length+2]...))
+		p.Append(int(p.Type), &r)
 	}
 	return length + 2, nil // Add 2 for the 2 byte header
 }
@@ -61,9 +62,14 @@ const (
 	CAP_ROUTE_FILTERING
 	CAP_MULTIPLE_ROUTES
 	CAP_EXTENDED_NEXTHOP
+	CAP_EXTENDED_MESSAGE // RFC 8654
 
+	CAP_ROLE             = 9 // RFC 9234
 	CAP_GRACEFUL_RESTART = 64
 	CAP_AS4              = 65
+	CAP_ADD_PATH         = 69 // RFC 7911
+	CAP_FQDN             = 73 // draft-walton-bgp-hostname-capability
+	CAP_SOFTWARE_VERSION = 75 // draft-abraitis-bgp-version-capability
 )
 
 type typeData struct {
@@ -87,12 +93,35 @@ func (c *Capability) Append(t int, v ...interface{}) error {
 		c.data = append(c.data, typeData{CAP_MULTI_PROTOCOL, d})
 	case CAP_ROUTE_REFRESH:
 		c.data = append(c.data, typeData{CAP_ROUTE_REFRESH, nil})
+	case CAP_EXTENDED_MESSAGE:
+		c.data = append(c.data, typeData{CAP_EXTENDED_MESSAGE, nil})
 	case CAP_AS4:
 		d := make([]byte, 4)
 		binary.BigEndian.PutUint32(d, uint32(v[0].(int)))
 		c.data = append(c.data, typeData{CAP_AS4, d})
+	case CAP_ROLE:
+		c.data = append(c.data, typeData{CAP_ROLE, []byte{byte(v[0].(Role) - 1)}})
+	case CAP_FQDN:
+		if len(v) != 2 {
+			return nil
+		}
+		d := appendString(nil, v[0].(string))
+		d = appendString(d, v[1].(string))
+		c.data = append(c.data, typeData{CAP_FQDN, d})
+	case CAP_GRACEFUL_RESTART:
+		c.data = append(c.data, typeData{CAP_GRACEFUL_RESTART, v[0].(*GracefulRestart).bytes()})
+	case CAP_SOFTWARE_VERSION:
+		c.data = append(c.data, typeData{CAP_SOFTWARE_VERSION, appendString(nil, v[0].(string))})
+	case CAP_ADD_PATH:
+		c.data = append(c.data, typeData{CAP_ADD_PATH, addPathBytes(v[0].([]AddPathFamily))})
 	default:
-		// unknown capability
+		// Unknown capability, the value must be given in wire format.
+		if len(v) != 1 {
+			return nil
+		}
+		if d, ok := v[0].([]byte); ok {
+			c.data = append(c.data, typeData{t, d})
+		}
 	}
 	return nil
 }
@@ -100,61 +129,132 @@ func (c *Capability) Append(t int, v ...interface{}) error {
 func (c *Capability) Bytes() []byte {
 	buf := make([]byte, 0)
 	for _, d := range c.data {
-		switch d.t {
-		case CAP_MULTI_PROTOCOL:
-			buf = append(buf, CAP_MULTI_PROTOCOL)
-			buf = append(buf, 4) // length
-			buf = append(buf, d.d...)
-		case CAP_ROUTE_REFRESH:
-			buf = append(buf, CAP_ROUTE_REFRESH)
-			buf = append(buf, 0) // length
-			// no data
-		case CAP_AS4:
-			buf = append(buf, CAP_AS4)
-			buf = append(buf, 4) // length
-			buf = append(buf, d.d...)
-		}
+		buf = append(buf, byte(d.t), byte(len(d.d)))
+		buf = append(buf, d.d...)
 	}
 	return buf
 }
 
+// SetBytes sets the capabilities from buf. Capabilities this package does not know
+// about are kept as is, so they can be inspected with Get.
 func (c *Capability) SetBytes(buf []byte) (int, error) {
 	i := 0
 	for i < len(buf) {
-		switch buf[i] {
-		// i+1 will overflow: TODO
+		if len(buf[i:]) < 2 || len(buf[i:]) < 2+int(buf[i+1]) {
+			return i, malformedCapability(buf[i:], "capability overruns parameter")
+		}
+		t := int(buf[i])
+		tlv := buf[i : i+2+int(buf[i+1])]
+		d := tlv[2:]
+		switch t {
 		case CAP_MULTI_PROTOCOL:
-			if buf[i+1] != 4 {
-				println("bgp: CAP_MULTI_PROTOCOL not 4 bytes", int(buf[i+1]))
-				return i, errBuf
+			if len(d) != 4 {
+				return i, malformedCapability(tlv, "CAP_MULTI_PROTOCOL not 4 bytes")
 			}
-			afi := int(binary.BigEndian.Uint16(buf[i+2:]))
-			safi := int((buf[i+5]))
+			afi := int(binary.BigEndian.Uint16(d))
+			safi := int(d[3])
 			c.Append(CAP_MULTI_PROTOCOL, afi, safi)
-			i += 6
 		case CAP_ROUTE_REFRESH:
-			if buf[i+1] != 0 {
-				println("bgp: CAP_ROUTE_REFRESH not 0 bytes", int(buf[i+1]))
-				return i, errBuf
+			if len(d) != 0 {
+				return i, malformedCapability(tlv, "CAP_ROUTE_REFRESH not 0 bytes")
 			}
 			c.Append(CAP_ROUTE_REFRESH, nil)
-			i += 2
-		case CAP_AS4:
-			if len(buf[i:]) < 6 {
-				return i, errBuf
+		case CAP_EXTENDED_MESSAGE:
+			if len(d) != 0 {
+				return i, malformedCapability(tlv, "CAP_EXTENDED_MESSAGE not 0 bytes")
 			}
-			if buf[i+1] != 4 {
-				println("bgp: CAP_AS4 not 4 bytes")
-				return i, errBuf
+			c.Append(CAP_EXTENDED_MESSAGE)
+		case CAP_AS4:
+			if len(d) != 4 {
+				return i, malformedCapability(tlv, "CAP_AS4 not 4 bytes")
 			}
 			// We going from binary->uint32->binary, we might not be the best way
-			v := binary.BigEndian.Uint32(buf[i+2 : i+6])
+			v := binary.BigEndian.Uint32(d)
 			c.Append(CAP_AS4, int(v))
-			i += 7
+		case CAP_ROLE:
+			if len(d) != 1 {
+				return i, malformedCapability(tlv, "CAP_ROLE not 1 byte")
+			}
+			// Kept as is, a Role can not hold all values.
+			c.data = append(c.data, typeData{CAP_ROLE, []byte{d[0]}})
+		case CAP_FQDN:
+			host, n := setString(d)
+			domain, m := setString(d[n:])
+			if n == 0 || m == 0 || n+m != len(d) {
+				return i, malformedCapability(tlv, "CAP_FQDN malformed")
+			}
+			c.Append(CAP_FQDN, host, domain)
+		case CAP_GRACEFUL_RESTART:
+			g := &GracefulRestart{}
+			if !g.setBytes(d) {
+				return i, malformedCapability(tlv, "CAP_GRACEFUL_RESTART malformed")
+			}
+			c.Append(CAP_GRACEFUL_RESTART, g)
+		case CAP_SOFTWARE_VERSION:
+			version, n := setString(d)
+			if n == 0 || n != len(d) {
+				return i, malformedCapability(tlv, "CAP_SOFTWARE_VERSION malformed")
+			}
+			c.Append(CAP_SOFTWARE_VERSION, version)
+		case CAP_ADD_PATH:
+			families, ok := setAddPath(d)
+			if !ok {
+				return i, malformedCapability(tlv, "CAP_ADD_PATH malformed")
+			}
+			c.Append(CAP_ADD_PATH, families)
 		default:
-			println("bgp: unknown capability", buf[i])
-			i++
+			c.Append(t, append([]byte(nil), d...))
 		}
+		i += 2 + len(d)
 	}
 	return i, nil
 }
+
+// malformedCapability returns the OPEN Message Error for the malformed capability in
+// tlv, which is sent back in the data of the NOTIFICATION.
+func malformedCapability(tlv []byte, reason string) *Error {
+	e := NewError(2, 0, reason)
+	e.Data = append([]byte(nil), tlv...)
+	return e
+}
+
+// Get returns the value, in wire format, of the first capability with code t.
+func (c *Capability) Get(t int) ([]byte, bool) {
+	for _, d := range c.data {
+		if d.t == t {
+			return d.d, true
+		}
+	}
+	return nil, false
+}
+
+// capabilities returns all capabilities advertised in the parameters of m.
+func (m *Open) capabilities() []typeData {
+	var caps []typeData
+	for _, p := range m.Parameters {
+		for _, d := range p.data {
+			if c, ok := d.(*Capability); ok {
+				caps = append(caps, c.data...)
+			}
+		}
+	}
+	return caps
+}
+
+// appendString appends s as a length prefixed string to buf, s is truncated to 255 bytes.
+func appendString(buf []byte, s string) []byte {
+	if len(s) > 255 {
+		s = s[:255]
+	}
+	buf = append(buf, byte(len(s)))
+	return append(buf, s...)
+}
+
+// setString returns the length prefixed string at the start of buf and the number of
+// bytes used. If buf is too short, 0 is returned as the length.
+func setString(buf []byte) (string, int) {
+	if len(buf) < 1 || len(buf) < 1+int(buf[0]) {
+		return "", 0
+	}
+	return string(buf[1 : 1+int(buf[0])]), 1 + int(buf[0])
+}
@@ -0,0 +1,103 @@
+package bgp
+
+// Maximum prefix limits, RFC 4271, Section 8.1.2 and RFC 4486, Section 4.
+
+import (
+	"encoding/binary"
+	"strconv"
+	"time"
+)
+
+// PrefixLimit limits the number of prefixes a peer may announce in a family, see
+// Session.PrefixLimits. Prefixes are counted in the pre-policy view of the Adj-RIB-In.
+type PrefixLimit struct {
+	Family Family
+	// Max is the maximum number of prefixes, when the peer exceeds it the session is
+	// closed with a Cease NOTIFICATION, Maximum Number of Prefixes Reached.
+	Max int
+	// Warning, if not zero, is the percentage of Max at which AdjRIBIn.OnPrefixWarning
+	// is called.
+	Warning int
+	// RestartAfter, if not zero, is the time a Server refuses connections to and from
+	// the neighbor after the limit is exceeded. Otherwise the usual time between
+	// connection attempts is used.
+	RestartAfter time.Duration
+}
+
+// limit returns the prefix limit of s for family f, or nil.
+func (s *Session) limit(f Family) *PrefixLimit {
+	for i := range s.PrefixLimits {
+		if s.PrefixLimits[i].Family == f {
+			return &s.PrefixLimits[i]
+		}
+	}
+	return nil
+}
+
+// maxPrefixes ends the session because the peer exceeded limit l. The data of the
+// NOTIFICATION holds the AFI, SAFI and the limit, RFC 4486, Section 4.
+func (s *Session) maxPrefixes(l *PrefixLimit) error {
+	e := NewError(6, 1, strconv.Itoa(l.Max)+" prefixes in "+l.Family.String())
+	e.Data = binary.BigEndian.AppendUint32(l.Family.bytes(), uint32(l.Max))
+	s.mu.Lock()
+	if s.err == nil {
+		s.exceeded = l
+	}
+	s.mu.Unlock()
+	return s.notify(e)
+}
+
+// exceededLimit returns the prefix limit that ended the session, or nil.
+func (s *Session) exceededLimit() *PrefixLimit {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.exceeded
+}
+
+// overLimit returns the prefix limit of the session that is exceeded when a prefix
+// is added to the n prefixes in family f, or nil. The caller must hold r.mu.
+func (r *AdjRIBIn) overLimit(f Family, n int) *PrefixLimit {
+	if l := r.Session.limit(f); l != nil && n+1 > l.Max {
+		return l
+	}
+	return nil
+}
+
+// warnLimit checks the number of prefixes n in family f against the warning threshold
+// of its limit. The caller must hold r.mu.
+func (r *AdjRIBIn) warnLimit(f Family, n int) {
+	l := r.Session.limit(f)
+	if l == nil || l.Warning == 0 || r.OnPrefixWarning == nil {
+		return
+	}
+	warn := n*100 >= l.Max*l.Warning
+	if warn == r.warned[f] {
+		return
+	}
+	if r.warned == nil {
+		r.warned = map[Family]bool{}
+	}
+	r.warned[f] = warn
+	if warn {
+		r.OnPrefixWarning(*l, n)
+	}
+}
+
+// holdDown holds down the neighbor of s for the RestartAfter of the prefix limit that
+// ended s, if any.
+func (srv *Server) holdDown(s *Session) {
+	n, l := s.neighbor, s.exceededLimit()
+	if n == nil || l == nil || l.RestartAfter == 0 {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.backoff.HoldDown = srv.clock().Now().Add(l.RestartAfter)
+}
+
+// heldDown returns true if connections with n are refused at time now.
+func (n *Neighbor) heldDown(now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return now.Before(n.backoff.HoldDown)
+}
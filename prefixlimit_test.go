@@ -0,0 +1,67 @@
+package bgp
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPrefixLimit(t *testing.T) {
+	limit := PrefixLimit{Family: ipv4Unicast, Max: 2, Warning: 50, RestartAfter: time.Hour}
+	a := &Session{AS: 65000, BGPIdentifier: net.IPv4(10, 0, 0, 1), PrefixLimits: []PrefixLimit{limit}}
+	b := &Session{AS: 65001, BGPIdentifier: net.IPv4(10, 0, 0, 2)}
+	if erra, errb := establish(t, a, b); erra != nil || errb != nil {
+		t.Fatalf("establish failed: %v, %v", erra, errb)
+	}
+
+	var warnings []int
+	r := &AdjRIBIn{Session: a, OnPrefixWarning: func(l PrefixLimit, n int) { warnings = append(warnings, n) }}
+	for _, p := range []string{"10.0.0.0/16", "10.1.0.0/16"} {
+		r.Add(ipv4Unicast, &Route{Prefix: prefix(p)})
+	}
+	r.Remove(ipv4Unicast, prefix("10.1.0.0/16"), 0)
+	r.Remove(ipv4Unicast, prefix("10.0.0.0/16"), 0)
+	r.Add(ipv4Unicast, &Route{Prefix: prefix("10.1.0.0/16")})
+	if len(warnings) != 2 || warnings[0] != 1 || warnings[1] != 1 {
+		t.Fatalf("expected two warnings at 1 prefix, got %v", warnings)
+	}
+
+	errc := make(chan error)
+	go func() {
+		_, err := b.ReadMsg()
+		errc <- err
+	}()
+	for _, p := range []string{"10.2.0.0/16", "10.3.0.0/16"} {
+		r.Add(ipv4Unicast, &Route{Prefix: prefix(p)})
+	}
+	var e *Error
+	if err := <-errc; !errors.Is(err, ErrMaxPrefixes) || !errors.As(err, &e) {
+		t.Fatalf("expected maximum number of prefixes reached, got %v", err)
+	}
+	if string(e.Data) != "\x00\x01\x01\x00\x00\x00\x02" {
+		t.Fatalf("unexpected data: %x", e.Data)
+	}
+	// The route over the limit and all routes after it are dropped.
+	r.Apply(&Update{ReachabilityInfo: []Prefix{prefix("10.4.0.0/16")}})
+	r.Add(ipv4Unicast, &Route{Prefix: prefix("10.1.0.0/16"), NextHop: net.IPv4(192, 0, 2, 1)})
+	if _, prefixes := r.Count(PrePolicy, ipv4Unicast); prefixes != 2 {
+		t.Fatalf("expected 2 prefixes, got %d", prefixes)
+	}
+	if rs := r.Lookup(PrePolicy, ipv4Unicast, prefix("10.1.0.0/16")); rs[0].NextHop != nil {
+		t.Fatalf("expected routes to be dropped after the limit was exceeded")
+	}
+
+	// The neighbor is held down for RestartAfter.
+	c := &fakeClock{}
+	srv := &Server{Clock: c}
+	n := &Neighbor{}
+	a.neighbor = n
+	srv.holdDown(a)
+	if !n.heldDown(c.Now()) {
+		t.Fatalf("expected neighbor to be held down")
+	}
+	if d := srv.retry(n, 0, e); d != time.Hour {
+		t.Fatalf("expected retry after an hour, got %s", d)
+	}
+}
@@ -0,0 +1,118 @@
+package bgp
+
+// Graceful restart, RFC 4724, and notification support for it, RFC 8538.
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// GracefulRestart holds the parameters of the graceful restart capability.
+type GracefulRestart struct {
+	Restarting bool // R bit: the speaker has restarted.
+	// Notification is the N bit: graceful restart is also used when the session ends
+	// with a NOTIFICATION, except for a Hard Reset.
+	Notification bool
+	Time         uint16 // Restart time in seconds, only the lower 12 bits are used.
+	Families     []RestartFamily
+}
+
+// RestartFamily is a family for which graceful restart is supported.
+type RestartFamily struct {
+	Family
+	Forwarding bool // F bit: forwarding state has been preserved.
+}
+
+func (g *GracefulRestart) bytes() []byte {
+	flags := g.Time & 0x0fff
+	if g.Restarting {
+		flags |= 0x8000
+	}
+	if g.Notification {
+		flags |= 0x4000
+	}
+	buf := []byte{byte(flags >> 8), byte(flags)}
+	for _, f := range g.Families {
+		buf = append(buf, f.Family.bytes()...)
+		if f.Forwarding {
+			buf = append(buf, 0x80)
+			continue
+		}
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+// setBytes sets g from the capability value in buf and returns false if buf is malformed.
+func (g *GracefulRestart) setBytes(buf []byte) bool {
+	if len(buf) < 2 || (len(buf)-2)%4 != 0 {
+		return false
+	}
+	flags := binary.BigEndian.Uint16(buf)
+	g.Restarting = flags&0x8000 != 0
+	g.Notification = flags&0x4000 != 0
+	g.Time = flags & 0x0fff
+	for i := 2; i < len(buf); i += 4 {
+		f := RestartFamily{Family{binary.BigEndian.Uint16(buf[i:]), buf[i+2]}, buf[i+3]&0x80 != 0}
+		g.Families = append(g.Families, f)
+	}
+	return true
+}
+
+// hardCease holds the Cease subcodes that are sent as a Hard Reset, RFC 8538, Section 5.
+// Administrative Reset is left to the operator, see Session.HardAdminReset.
+var hardCease = map[uint8]bool{
+	1: true, // Maximum Number of Prefixes Reached
+	2: true, // Administrative Shutdown
+	3: true, // Peer De-configured
+}
+
+// notificationRestart returns true if both sides advertised the N bit in graceful restart.
+func (s *Session) notificationRestart() bool {
+	return s.GracefulRestart != nil && s.GracefulRestart.Notification &&
+		s.state.GracefulRestart != nil && s.state.GracefulRestart.Notification
+}
+
+// hardReset returns n wrapped in a Hard Reset when n must end graceful restart, otherwise
+// n is returned.
+func (s *Session) hardReset(n *Notification) *Notification {
+	if !s.notificationRestart() || n.ErrorCode != 6 {
+		return n
+	}
+	if !hardCease[n.ErrorSubcode] && !(n.ErrorSubcode == 4 && s.HardAdminReset) {
+		return n
+	}
+	return &Notification{ErrorCode: 6, ErrorSubcode: 9, Data: bytes(n)[headerLen:]}
+}
+
+// wrapNotification returns n, wrapped in a Hard Reset when needed, and the error for
+// the NOTIFICATION that is sent. E is used as the error for n when given.
+func (s *Session) wrapNotification(n *Notification, e *Error) (*Notification, *Error) {
+	h := s.hardReset(n)
+	if e == nil {
+		e = n.error()
+	}
+	if h == n {
+		return n, e
+	}
+	hard := NewError(6, 9, strings.TrimPrefix(e.Error(), "bgp: "))
+	hard.Data = h.Data
+	hard.wrapped = e
+	return h, hard
+}
+
+// PreserveRoutes reports whether the routes received from the peer should be kept,
+// and marked as stale, after the session ended with err. This is the case when
+// graceful restart was negotiated and the session did not end with a NOTIFICATION,
+// or, when the N bit was negotiated, with a NOTIFICATION that is not a Hard Reset.
+func (s *Session) PreserveRoutes(err error) bool {
+	if s.GracefulRestart == nil || s.state.GracefulRestart == nil {
+		return false
+	}
+	var e *Error
+	if !errors.As(err, &e) {
+		return true
+	}
+	return s.notificationRestart() && !errors.Is(err, ErrHardReset)
+}
@@ -0,0 +1,361 @@
+package bgp
+
+import (
+	"net"
+	"sync"
+)
+
+// Route is a path to a prefix received from a peer.
+type Route struct {
+	Prefix Prefix
+	// PathID is the path identifier of ADD-PATH (RFC 7911), it is zero for peers that
+	// do not send multiple paths.
+	PathID uint32
+	// NextHop is the NEXT_HOP attribute, or the first next hop in MP_REACH_NLRI.
+	NextHop net.IP
+	// Attributes holds the path attributes, without MP_REACH_NLRI and MP_UNREACH_NLRI.
+	// It is shared by all routes from the same UPDATE and must not be modified.
+	Attributes []Attribute
+}
+
+// Policy is applied to routes received from a peer. It returns false to reject the
+// route. To change the attributes a policy must set a new slice.
+type Policy func(f Family, r *Route) bool
+
+// View selects the routes of an Adj-RIB-In, before or after applying the policy.
+type View int
+
+const (
+	PrePolicy View = iota
+	PostPolicy
+)
+
+// AdjRIBIn holds the routes received from a single peer, per address family. Received
+// routes are kept as is in the pre-policy view, the routes accepted by Policy in the
+// post-policy view. An AdjRIBIn can be used from multiple goroutines.
+type AdjRIBIn struct {
+	// Policy, if not nil, is applied to routes for the post-policy view. After changing
+	// it, call Refresh.
+	Policy Policy
+	// LocRIB, if not nil, gets the routes of the post-policy view as candidates, with
+	// Peer as the peer they were received from.
+	LocRIB *LocRIB
+	Peer   *Peer
+	// Attrs, if not nil, interns the attributes of the received routes.
+	Attrs *AttrTable
+	// Dampening, if not nil, penalizes withdrawals and attribute changes of routes
+	// and withholds suppressed prefixes from the Loc-RIB. Routes removed by Clear are
+	// not penalized. It may be shared by Adj-RIB-Ins with different Peers.
+	Dampening *Dampening
+	// Session, if not nil, is the session with the peer. Its prefix limits are
+	// checked for every added route.
+	Session *Session
+	// OnPrefixWarning, if not nil, is called when the number of prefixes in a family
+	// reaches the warning threshold of its limit. It is called again only after the
+	// number dropped below the threshold.
+	OnPrefixWarning func(l PrefixLimit, prefixes int)
+
+	mu       sync.RWMutex
+	pre      table
+	post     table
+	warned   map[Family]bool // Families that are above the warning threshold.
+	exceeded bool            // A prefix limit was exceeded, routes are dropped until Clear.
+}
+
+// Apply applies the withdrawals and announcements in u. Routes in WithdrawnRoutes
+// and ReachabilityInfo are IPv4 unicast. Path identifiers are taken from u when it
+// has them, otherwise they are zero.
+func (r *AdjRIBIn) Apply(u *Update) {
+	var (
+		attrs   []Attribute
+		nh      net.IP
+		reaches []*MPReach
+	)
+	for _, a := range u.Attributes {
+		switch v := a.Value().(type) {
+		case *MPReach:
+			reaches = append(reaches, v)
+			continue
+		case *MPUnreach:
+			for i, p := range v.WithdrawnRoutes {
+				r.Remove(v.Family, p, pathID(v.PathIDs, i))
+			}
+			continue
+		case *NextHop:
+			nh = net.IP(*v)
+		}
+		attrs = append(attrs, a)
+	}
+	if r.Attrs != nil {
+		// Intern once, so every route below finds the interned set without encoding it.
+		attrs = r.Attrs.Intern(attrs)
+		defer r.Attrs.Release(attrs)
+	}
+	for i, p := range u.WithdrawnRoutes {
+		r.Remove(ipv4Unicast, p, pathID(u.WithdrawnPathIDs, i))
+	}
+	for i, p := range u.ReachabilityInfo {
+		if !r.add(ipv4Unicast, &Route{Prefix: p, PathID: pathID(u.PathIDs, i), NextHop: nh, Attributes: attrs}) {
+			return
+		}
+	}
+	for _, m := range reaches {
+		nh = nil
+		if len(m.NextHop) > 0 {
+			nh = m.NextHop[0]
+		}
+		for i, p := range m.NLRI {
+			if !r.add(m.Family, &Route{Prefix: p, PathID: pathID(m.PathIDs, i), NextHop: nh, Attributes: attrs}) {
+				return
+			}
+		}
+	}
+}
+
+// pathID returns the i-th path identifier in ids, or zero if there are none.
+func pathID(ids []uint32, i int) uint32 {
+	if i < len(ids) {
+		return ids[i]
+	}
+	return 0
+}
+
+// Add adds route rt for family f, replacing the route with the same prefix and path ID.
+// A route for a new prefix that would exceed a prefix limit of Session is dropped and
+// the session is closed, all further routes are dropped until Clear.
+func (r *AdjRIBIn) Add(f Family, rt *Route) { r.add(f, rt) }
+
+// add is Add, it returns false if rt was dropped because of a prefix limit.
+func (r *AdjRIBIn) add(f Family, rt *Route) bool {
+	r.mu.Lock()
+	if r.exceeded {
+		r.mu.Unlock()
+		return false
+	}
+	if r.Session != nil && r.pre[f][rt.Prefix.String()] == nil {
+		if l := r.overLimit(f, len(r.pre[f])); l != nil {
+			r.exceeded = true
+			s := r.Session
+			// The NOTIFICATION may block, it is sent without holding r.mu.
+			r.mu.Unlock()
+			s.maxPrefixes(l)
+			return false
+		}
+	}
+	defer r.mu.Unlock()
+	if r.pre == nil {
+		r.pre, r.post = table{}, table{}
+	}
+	if r.Attrs != nil {
+		rt.Attributes = r.Attrs.Intern(rt.Attributes)
+	}
+	old := r.pre.add(f, rt)
+	if old != nil && r.Dampening != nil && !sameRoute(old, rt) {
+		r.Dampening.penalize(r.Peer, f, rt.Prefix, attributesPenalty, func() { r.reuse(f, rt.Prefix) })
+	}
+	r.release(old)
+	if post := r.policy(f, rt); post != nil {
+		r.post.add(f, post)
+	} else {
+		r.post.remove(f, rt.Prefix, rt.PathID)
+	}
+	r.changed(f, rt.Prefix)
+	if r.Session != nil {
+		r.warnLimit(f, len(r.pre[f]))
+	}
+	return true
+}
+
+// Remove removes the route for prefix p with path ID id in family f.
+func (r *AdjRIBIn) Remove(f Family, p Prefix, id uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.pre.remove(f, p, id)
+	if old != nil && r.Dampening != nil {
+		r.Dampening.penalize(r.Peer, f, p, withdrawPenalty, func() { r.reuse(f, p) })
+	}
+	r.release(old)
+	r.post.remove(f, p, id)
+	r.changed(f, p)
+	if r.Session != nil {
+		r.warnLimit(f, len(r.pre[f]))
+	}
+}
+
+// Clear removes all routes, as needed when the session with the peer ends.
+func (r *AdjRIBIn) Clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.post
+	for _, prefixes := range r.pre {
+		for _, routes := range prefixes {
+			for _, rt := range routes {
+				r.release(rt)
+			}
+		}
+	}
+	r.pre, r.post, r.warned, r.exceeded = nil, nil, nil, false
+	r.changedAll(old)
+}
+
+// release releases the interned attributes of rt, if rt is not nil.
+func (r *AdjRIBIn) release(rt *Route) {
+	if rt != nil && r.Attrs != nil {
+		r.Attrs.Release(rt.Attributes)
+	}
+}
+
+// Refresh applies the policy again to all routes, as needed after the policy changed.
+func (r *AdjRIBIn) Refresh() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.post
+	r.post = table{}
+	for f, prefixes := range r.pre {
+		for _, routes := range prefixes {
+			for _, rt := range routes {
+				if post := r.policy(f, rt); post != nil {
+					r.post.add(f, post)
+				}
+			}
+		}
+	}
+	r.changedAll(old)
+	r.changedAll(r.post)
+}
+
+// Lookup returns the routes for prefix p in family f, one for each path ID.
+func (r *AdjRIBIn) Lookup(v View, f Family, p Prefix) []*Route {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]*Route(nil), r.view(v)[f][p.String()]...)
+}
+
+// Walk calls fn for every route in family f, until fn returns false. The order is not
+// defined. Fn must not modify r.
+func (r *AdjRIBIn) Walk(v View, f Family, fn func(*Route) bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, routes := range r.view(v)[f] {
+		for _, rt := range routes {
+			if !fn(rt) {
+				return
+			}
+		}
+	}
+}
+
+// Count returns the number of routes and the number of prefixes in family f.
+func (r *AdjRIBIn) Count(v View, f Family) (routes, prefixes int) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, rs := range r.view(v)[f] {
+		routes += len(rs)
+	}
+	return routes, len(r.view(v)[f])
+}
+
+// Families returns the families that have routes in the pre-policy view.
+func (r *AdjRIBIn) Families() []Family {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	fams := make([]Family, 0, len(r.pre))
+	for f := range r.pre {
+		fams = append(fams, f)
+	}
+	return fams
+}
+
+// changed passes the post-policy routes for prefix p to the Loc-RIB, or none if p is
+// suppressed.
+func (r *AdjRIBIn) changed(f Family, p Prefix) {
+	if r.LocRIB == nil {
+		return
+	}
+	if r.Dampening != nil && r.Dampening.suppressed(r.Peer, f, p) {
+		r.LocRIB.set(r.Peer, f, p, nil)
+		return
+	}
+	r.LocRIB.set(r.Peer, f, p, r.post[f][p.String()])
+}
+
+// reuse passes the routes for prefix p to the Loc-RIB again, after dampening stopped
+// suppressing it.
+func (r *AdjRIBIn) reuse(f Family, p Prefix) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.changed(f, p)
+}
+
+// changedAll calls changed for all prefixes in t.
+func (r *AdjRIBIn) changedAll(t table) {
+	for f, prefixes := range t {
+		for _, routes := range prefixes {
+			r.changed(f, routes[0].Prefix)
+		}
+	}
+}
+
+func (r *AdjRIBIn) view(v View) table {
+	if v == PostPolicy {
+		return r.post
+	}
+	return r.pre
+}
+
+// policy returns the post-policy route for rt, or nil if rt is rejected.
+func (r *AdjRIBIn) policy(f Family, rt *Route) *Route {
+	if r.Policy == nil {
+		return rt
+	}
+	post := *rt
+	if !r.Policy(f, &post) {
+		return nil
+	}
+	return &post
+}
+
+// table holds routes per family and prefix, with one route for each path ID.
+type table map[Family]map[string][]*Route
+
+// add adds rt and returns the route it replaced, if any.
+func (t table) add(f Family, rt *Route) *Route {
+	prefixes := t[f]
+	if prefixes == nil {
+		prefixes = map[string][]*Route{}
+		t[f] = prefixes
+	}
+	key := rt.Prefix.String()
+	routes := prefixes[key]
+	for i := range routes {
+		if routes[i].PathID == rt.PathID {
+			old := routes[i]
+			routes[i] = rt
+			return old
+		}
+	}
+	prefixes[key] = append(routes, rt)
+	return nil
+}
+
+// remove removes the route for p with path ID id and returns it, if it was found.
+func (t table) remove(f Family, p Prefix, id uint32) *Route {
+	prefixes := t[f]
+	key := p.String()
+	routes := prefixes[key]
+	for i, rt := range routes {
+		if rt.PathID != id {
+			continue
+		}
+		if len(routes) == 1 {
+			delete(prefixes, key)
+			if len(prefixes) == 0 {
+				delete(t, f)
+			}
+			return rt
+		}
+		prefixes[key] = append(routes[:i:i], routes[i+1:]...)
+		return rt
+	}
+	return nil
+}
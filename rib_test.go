@@ -0,0 +1,53 @@
+package bgp
+
+import (
+	"net"
+	"testing"
+)
+
+func prefix(s string) Prefix {
+	_, p, _ := net.ParseCIDR(s)
+	return Prefix(*p)
+}
+
+func TestAdjRIBIn(t *testing.T) {
+	ipv4, ipv6 := Family{AFI_IP, SAFI_UNICAST}, Family{AFI_IP6, SAFI_UNICAST}
+	u := &Update{ReachabilityInfo: []Prefix{prefix("10.0.0.0/16"), prefix("10.1.0.0/16")}, Attributes: make([]Attribute, 4)}
+	o, nh := Origin(IGP), NextHop(net.IPv4(192, 0, 2, 1))
+	u.Attributes[0].Append(origin, &o)
+	u.Attributes[1].Append(path, &Path{{Type: AS_SEQUENCE, AS: []uint32{65001}}})
+	u.Attributes[2].Append(next_hop, &nh)
+	u.Attributes[3].Append(mp_reach_nlri, &MPReach{Family: ipv6, NextHop: []net.IP{net.ParseIP("2001:db8::1")}, NLRI: []Prefix{prefix("2001:db8:1::/48")}})
+
+	r := &AdjRIBIn{Policy: func(f Family, rt *Route) bool { return rt.Prefix.String() != "10.1.0.0/16" }}
+	r.Apply(u)
+	if routes, prefixes := r.Count(PrePolicy, ipv4); routes != 2 || prefixes != 2 {
+		t.Fatalf("expected 2 pre-policy routes, got %d", routes)
+	}
+	if routes, _ := r.Count(PostPolicy, ipv4); routes != 1 {
+		t.Fatalf("expected 1 post-policy route, got %d", routes)
+	}
+	rs := r.Lookup(PostPolicy, ipv6, prefix("2001:db8:1::/48"))
+	if len(rs) != 1 || !rs[0].NextHop.Equal(net.ParseIP("2001:db8::1")) || len(rs[0].Attributes) != 3 {
+		t.Fatalf("unexpected IPv6 route: %+v", rs)
+	}
+
+	// A second path with ADD-PATH.
+	r.Add(ipv4, &Route{Prefix: prefix("10.0.0.0/16"), PathID: 2, NextHop: net.IPv4(192, 0, 2, 2)})
+	if rs := r.Lookup(PrePolicy, ipv4, prefix("10.0.0.0/16")); len(rs) != 2 {
+		t.Fatalf("expected 2 paths, got %d", len(rs))
+	}
+
+	r.Policy = nil
+	r.Refresh()
+	if routes, prefixes := r.Count(PostPolicy, ipv4); routes != 3 || prefixes != 2 {
+		t.Fatalf("expected 3 post-policy routes after refresh, got %d", routes)
+	}
+
+	r.Apply(&Update{WithdrawnRoutes: []Prefix{prefix("10.0.0.0/16"), prefix("10.1.0.0/16")}})
+	n := 0
+	r.Walk(PostPolicy, ipv4, func(rt *Route) bool { n++; return true })
+	if n != 1 {
+		t.Fatalf("expected only the second path to remain, got %d routes", n)
+	}
+}
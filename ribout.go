@@ -0,0 +1,226 @@
+package bgp
+
+import (
+	"net"
+	"slices"
+	"sync"
+)
+
+// AdjRIBOut holds the routes advertised to a single peer, per address family. The
+// routes that should be advertised are set with Set or Apply, Updates returns the
+// UPDATEs that bring the peer from what was advertised to that state.
+type AdjRIBOut struct {
+	// Policy, if not nil, is applied to the routes before they are advertised.
+	Policy Policy
+	// MaxMessageSize is the maximum size of the generated UPDATEs. If zero, MaxSize
+	// is used. Use MaxExtendedSize only when State.ExtendedMessage is true.
+	MaxMessageSize int
+	// AddPath holds the families in which Apply advertises all paths of the multipath
+	// set, each with its own path identifier (RFC 7911). Only use families for which
+	// State.SendPathIDs is true. In other families only the best path is advertised.
+	AddPath []Family
+
+	mu         sync.Mutex
+	desired    table
+	advertised table
+	dirty      map[Family]map[string]Prefix
+}
+
+// Apply sets the routes for the prefix of c to its new best path, or to its new
+// multipath set in the families in AddPath.
+func (r *AdjRIBOut) Apply(c Change) {
+	var routes []*Route
+	switch {
+	case c.New == nil:
+	case slices.Contains(r.AddPath, c.Family):
+		for _, pr := range c.Paths {
+			routes = append(routes, pr.Route)
+		}
+	default:
+		routes = []*Route{c.New.Route}
+	}
+	r.SetPaths(c.Family, c.Prefix, routes)
+}
+
+// Set sets the route to advertise for prefix p in family f, a nil rt withdraws it.
+func (r *AdjRIBOut) Set(f Family, p Prefix, rt *Route) {
+	var routes []*Route
+	if rt != nil {
+		routes = []*Route{rt}
+	}
+	r.SetPaths(f, p, routes)
+}
+
+// SetPaths sets the routes to advertise for prefix p in family f, replacing all
+// routes set before. The path identifier of the i-th route accepted by the policy
+// is i+1 in the families in AddPath, elsewhere only the first route is advertised.
+func (r *AdjRIBOut) SetPaths(f Family, p Prefix, routes []*Route) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.desired == nil {
+		r.desired, r.advertised = table{}, table{}
+	}
+	addPath := slices.Contains(r.AddPath, f)
+	for _, rt := range r.desired[f][p.String()] {
+		r.desired.remove(f, p, rt.PathID)
+	}
+	id := uint32(0)
+	for _, rt := range routes {
+		out := *rt
+		if r.Policy != nil && !r.Policy(f, &out) {
+			continue
+		}
+		out.PathID = 0
+		if addPath {
+			id++
+			out.PathID = id
+		}
+		r.desired.add(f, &out)
+		if !addPath {
+			break
+		}
+	}
+	r.mark(f, p)
+}
+
+// Refresh marks all routes in family f to be advertised again, as needed after
+// receiving a ROUTE-REFRESH.
+func (r *AdjRIBOut) Refresh(f Family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.advertised, f)
+	for _, routes := range r.desired[f] {
+		r.mark(f, routes[0].Prefix)
+	}
+}
+
+// Advertised returns the route advertised for prefix p in family f, or nil. In the
+// families in AddPath it is the best path, see AdvertisedPaths for all of them.
+func (r *AdjRIBOut) Advertised(f Family, p Prefix) *Route {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if routes := r.advertised[f][p.String()]; len(routes) > 0 {
+		return routes[0]
+	}
+	return nil
+}
+
+// AdvertisedPaths returns the routes advertised for prefix p in family f.
+func (r *AdjRIBOut) AdvertisedPaths(f Family, p Prefix) []*Route {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Route(nil), r.advertised[f][p.String()]...)
+}
+
+// Count returns the number of prefixes advertised in family f.
+func (r *AdjRIBOut) Count(f Family) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.advertised[f])
+}
+
+// Updates returns the UPDATEs for the routes that changed since the last call, and
+// records them as advertised. Routes that changed back to what was advertised do not
+// lead to an UPDATE. Routes with the same attributes are packed in the same UPDATEs.
+func (r *AdjRIBOut) Updates() []*Update {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	size := r.maxMessageSize()
+	var ups []*Update
+	for f, prefixes := range r.dirty {
+		var (
+			withdrawn []*Route
+			announced []*Route
+		)
+		for key, p := range prefixes {
+			for _, have := range slices.Clone(r.advertised[f][key]) {
+				if r.desired.path(f, key, have.PathID) == nil {
+					withdrawn = append(withdrawn, have)
+					r.advertised.remove(f, p, have.PathID)
+				}
+			}
+			for _, want := range r.desired[f][key] {
+				if !sameRoute(want, r.advertised.path(f, key, want.PathID)) {
+					announced = append(announced, want)
+					r.advertised.add(f, want)
+				}
+			}
+		}
+		ups = append(ups, packUpdates(f, withdrawn, announced, size, slices.Contains(r.AddPath, f))...)
+	}
+	r.dirty = nil
+	return ups
+}
+
+func (r *AdjRIBOut) maxMessageSize() int {
+	if r.MaxMessageSize == 0 {
+		return MaxSize
+	}
+	return r.MaxMessageSize
+}
+
+func (r *AdjRIBOut) mark(f Family, p Prefix) {
+	if r.dirty == nil {
+		r.dirty = map[Family]map[string]Prefix{}
+	}
+	if r.dirty[f] == nil {
+		r.dirty[f] = map[string]Prefix{}
+	}
+	r.dirty[f][p.String()] = p
+}
+
+// path returns the route with path ID id for the prefix with key in family f, or nil.
+func (t table) path(f Family, key string, id uint32) *Route {
+	for _, rt := range t[f][key] {
+		if rt.PathID == id {
+			return rt
+		}
+	}
+	return nil
+}
+
+// sameRoute returns true if a and b have the same next hop and attributes.
+func sameRoute(a, b *Route) bool {
+	if b == nil || !a.NextHop.Equal(b.NextHop) || len(a.Attributes) != len(b.Attributes) {
+		return false
+	}
+	for i := range a.Attributes {
+		if string(a.Attributes[i].Bytes()) != string(b.Attributes[i].Bytes()) {
+			return false
+		}
+	}
+	return true
+}
+
+var ipv4Unicast = Family{AFI_IP, SAFI_UNICAST}
+
+// announce returns an UPDATE with the attributes of rt in family f, without NLRI.
+// IPv4 unicast routes use NEXT_HOP, other families MP_REACH_NLRI.
+func announce(f Family, rt *Route) *Update {
+	u := &Update{Attributes: make([]Attribute, 0, len(rt.Attributes)+1)}
+	for _, a := range rt.Attributes {
+		if a.Code != next_hop {
+			u.Attributes = append(u.Attributes, a)
+		}
+	}
+	u.Attributes = append(u.Attributes, Attribute{})
+	a := &u.Attributes[len(u.Attributes)-1]
+	if f == ipv4Unicast {
+		nh := NextHop(rt.NextHop)
+		a.Append(next_hop, &nh)
+		return u
+	}
+	a.Append(mp_reach_nlri, &MPReach{Family: f, NextHop: []net.IP{rt.NextHop}})
+	return u
+}
+
+// withdraw returns the UPDATE withdrawing prefixes in family f, for families other than
+// IPv4 unicast it always has MP_UNREACH_NLRI.
+func withdraw(f Family, prefixes []Prefix) *Update {
+	if f == ipv4Unicast {
+		return &Update{WithdrawnRoutes: prefixes}
+	}
+	u := &Update{Attributes: make([]Attribute, 1)}
+	u.Attributes[0].Append(mp_unreach_nlri, &MPUnreach{Family: f, WithdrawnRoutes: prefixes})
+	return u
+}
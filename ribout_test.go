@@ -0,0 +1,80 @@
+package bgp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAdjRIBOut(t *testing.T) {
+	ipv6 := Family{AFI_IP6, SAFI_UNICAST}
+	r := &AdjRIBOut{}
+	rt := testRoute(0, 65001)
+	r.Set(ipv4Unicast, rt.Prefix, rt)
+	r.Set(ipv6, prefix("2001:db8::/32"), &Route{Prefix: prefix("2001:db8::/32"), NextHop: net.ParseIP("2001:db8::1"), Attributes: rt.Attributes})
+	ups := r.Updates()
+	if len(ups) != 2 || r.Count(ipv4Unicast) != 1 || r.Count(ipv6) != 1 {
+		t.Fatalf("expected 2 announcements, got %d", len(ups))
+	}
+	for _, u := range ups {
+		m, _, err := setBytes(u.bytes())
+		if err != nil {
+			t.Fatalf("generated UPDATE does not decode: %s", err)
+		}
+		if !m.(*Update).announces() {
+			t.Fatalf("expected announcement, got %+v", m)
+		}
+	}
+
+	// The same route again, as a copy, is not sent.
+	rt1 := *rt
+	r.Set(ipv4Unicast, rt.Prefix, &rt1)
+	if ups := r.Updates(); len(ups) != 0 {
+		t.Fatalf("expected no UPDATEs, got %d", len(ups))
+	}
+
+	r.Set(ipv6, prefix("2001:db8::/32"), nil)
+	ups = r.Updates()
+	if len(ups) != 1 || findAttr(ups[0].Attributes, mp_unreach_nlri) == nil || r.Count(ipv6) != 0 {
+		t.Fatalf("expected MP_UNREACH_NLRI withdrawal, got %+v", ups)
+	}
+
+	r.Refresh(ipv4Unicast)
+	if ups := r.Updates(); len(ups) != 1 || len(ups[0].ReachabilityInfo) != 1 {
+		t.Fatalf("expected the route to be sent again, got %+v", ups)
+	}
+}
+
+func TestAdjRIBOutAddPath(t *testing.T) {
+	r := &AdjRIBOut{AddPath: []Family{ipv4Unicast}}
+	a, b := testRoute(0, 65001), testRoute(0, 65002)
+	b.NextHop = net.IPv4(192, 0, 2, 2)
+	pa, pb := &PeerRoute{Route: a}, &PeerRoute{Route: b}
+	r.Apply(Change{Family: ipv4Unicast, Prefix: a.Prefix, New: pa, Paths: []*PeerRoute{pa, pb}})
+	ups := r.Updates()
+	if len(ups) != 2 {
+		t.Fatalf("expected 2 UPDATEs, got %d", len(ups))
+	}
+	ids := map[uint32]bool{}
+	for _, u := range ups {
+		m, _, err := decode(u.bytes(), map[Family]bool{ipv4Unicast: true})
+		if err != nil {
+			t.Fatalf("generated UPDATE does not decode: %s", err)
+		}
+		for _, id := range m.(*Update).PathIDs {
+			ids[id] = true
+		}
+	}
+	if len(ids) != 2 || !ids[1] || !ids[2] {
+		t.Fatalf("expected path IDs 1 and 2, got %v", ids)
+	}
+
+	// The second path goes away, only it is withdrawn.
+	r.Apply(Change{Family: ipv4Unicast, Prefix: a.Prefix, Old: pa, New: pa, Paths: []*PeerRoute{pa}})
+	ups = r.Updates()
+	if len(ups) != 1 || len(ups[0].WithdrawnRoutes) != 1 || len(ups[0].WithdrawnPathIDs) != 1 || ups[0].WithdrawnPathIDs[0] != 2 {
+		t.Fatalf("expected withdrawal of path 2, got %+v", ups)
+	}
+	if rs := r.AdvertisedPaths(ipv4Unicast, a.Prefix); len(rs) != 1 || rs[0].PathID != 1 {
+		t.Fatalf("expected path 1 to stay advertised, got %+v", rs)
+	}
+}
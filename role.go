@@ -0,0 +1,116 @@
+package bgp
+
+// BGP Roles and route leak prevention, RFC 9234.
+
+// Role is the BGP Role of a speaker. The values are one more than the values used
+// on the wire, so that the zero value means no role.
+type Role uint8
+
+// The different roles.
+const (
+	RoleNone Role = iota // No role is configured or advertised.
+	RoleProvider
+	RoleRS // Route Server.
+	RoleRSClient
+	RoleCustomer
+	RolePeer
+
+	// RoleUnknown is a role value advertised by a peer that is not defined in RFC 9234.
+	RoleUnknown Role = 255
+)
+
+var roleNames = map[Role]string{
+	RoleNone:     "none",
+	RoleProvider: "provider",
+	RoleRS:       "route server",
+	RoleRSClient: "route server client",
+	RoleCustomer: "customer",
+	RolePeer:     "peer",
+	RoleUnknown:  "unknown",
+}
+
+func (r Role) String() string {
+	if s, ok := roleNames[r]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// roleFromWire returns the role for the value b of the Role capability, RoleUnknown
+// for values that are not defined.
+func roleFromWire(b byte) Role {
+	if b >= byte(RolePeer) {
+		return RoleUnknown
+	}
+	return Role(b) + 1
+}
+
+// rolePairs holds the only role the remote side may have for each local role.
+var rolePairs = map[Role]Role{
+	RoleProvider: RoleCustomer,
+	RoleCustomer: RoleProvider,
+	RoleRS:       RoleRSClient,
+	RoleRSClient: RoleRS,
+	RolePeer:     RolePeer,
+}
+
+// ingress applies the ingress procedure of RFC 9234, Section 5 to u. Announced routes
+// that are leaked are treated as withdrawn, others get an OTC attribute when
+// received from a provider, peer or route server.
+func (s *Session) ingress(u *Update) {
+	if s.Role == RoleNone || !u.announces() {
+		return
+	}
+	a := findAttr(u.Attributes, only_to_customer)
+	if a == nil {
+		switch s.Role {
+		case RoleCustomer, RolePeer, RoleRSClient:
+			otc := OnlyToCustomer(s.state.AS)
+			u.Attributes = append(u.Attributes, Attribute{})
+			u.Attributes[len(u.Attributes)-1].Append(only_to_customer, &otc)
+		}
+		return
+	}
+
+	leak := false
+	switch s.Role {
+	case RoleProvider, RoleRS:
+		leak = true
+	case RolePeer:
+		leak = uint32(*a.Value().(*OnlyToCustomer)) != s.state.AS
+	}
+	if leak {
+		u.treatAsWithdraw()
+	}
+}
+
+// egress applies the egress procedure of RFC 9234, Section 5 to u. It returns the
+// update that should be sent, which may be a copy of u, or nil if nothing remains
+// to be sent.
+func (s *Session) egress(u *Update) *Update { return egress(s.Role, s.AS, u) }
+
+// egress is Session.egress for a session with our role and AS.
+func egress(role Role, as uint32, u *Update) *Update {
+	if role == RoleNone || !u.announces() {
+		return u
+	}
+	if findAttr(u.Attributes, only_to_customer) != nil {
+		switch role {
+		case RoleCustomer, RolePeer, RoleRSClient:
+			return u.withdrawals()
+		}
+		return u
+	}
+
+	switch role {
+	case RoleProvider, RolePeer, RoleRS:
+		otc := OnlyToCustomer(as)
+		u1 := *u
+		u1.Attributes = make([]Attribute, len(u.Attributes), len(u.Attributes)+1)
+		copy(u1.Attributes, u.Attributes)
+		u1.Attributes = append(u1.Attributes, Attribute{})
+		u1.Attributes[len(u1.Attributes)-1].Append(only_to_customer, &otc)
+		return &u1
+	}
+	return u
+}
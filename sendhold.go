@@ -0,0 +1,110 @@
+package bgp
+
+// Send hold timer, RFC 9687.
+
+import (
+	"time"
+)
+
+const (
+	// minSendHoldTime is the smallest send hold time used when none is configured.
+	minSendHoldTime = 8 * time.Minute
+	// sendHoldNotifyTimeout is how long we try to send the NOTIFICATION after the send
+	// hold timer expired.
+	sendHoldNotifyTimeout = time.Second
+)
+
+// SendHoldStats shows how close a session gets to the expiry of its send hold timer.
+type SendHoldStats struct {
+	SendHoldTime time.Duration // The send hold time in use.
+	Writes       uint64        // Number of messages written.
+	Blocked      time.Duration // How long the current write is blocked, zero if not writing.
+	MaxBlocked   time.Duration // Longest time a single write was blocked.
+}
+
+// SendHoldStats returns the send hold statistics of the session. It does not block
+// on pending writes.
+func (s *Session) SendHoldStats() SendHoldStats {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	st := s.sendStats
+	st.SendHoldTime = s.sendHoldTime()
+	if !s.writeStart.IsZero() {
+		st.Blocked = s.clock().Now().Sub(s.writeStart)
+	}
+	return st
+}
+
+// sendHoldTime returns the configured send hold time, or the larger of eight minutes
+// and twice the negotiated hold time, RFC 9687, Section 3.
+func (s *Session) sendHoldTime() time.Duration {
+	if s.SendHoldTime != 0 {
+		return s.SendHoldTime
+	}
+	d := 2 * time.Duration(s.state.HoldTime) * time.Second
+	if d < minSendHoldTime {
+		return minSendHoldTime
+	}
+	return d
+}
+
+// writeConn writes m to the connection while the send hold timer runs. If no progress
+// is made before it expires, the write is aborted, a NOTIFICATION is sent if possible
+// and a Send Hold Timer Expired error is returned. The caller must hold s.writeMu.
+func (s *Session) writeConn(m Msg) error {
+	if s.partial {
+		return &Error{Err: "write aborted part-way"}
+	}
+	d := s.sendHoldTime()
+	s.sendMu.Lock()
+	s.writeStart = s.clock().Now()
+	if s.sendHold == nil {
+		s.sendHold = s.clock().AfterFunc(d, s.sendHoldExpired)
+	} else {
+		s.sendHold.Reset(d)
+	}
+	s.sendMu.Unlock()
+
+	n, err := s.conn.Write(bytes(m))
+	if err != nil && n > 0 {
+		// The peer would read the rest of the stream as part of m.
+		s.partial = true
+	}
+
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	s.sendHold.Stop()
+	if blocked := s.clock().Now().Sub(s.writeStart); blocked > s.sendStats.MaxBlocked {
+		s.sendStats.MaxBlocked = blocked
+	}
+	s.writeStart = time.Time{}
+	expired := s.sendExpired
+	s.sendExpired = false
+	if err == nil {
+		s.sendStats.Writes++
+		if expired {
+			s.conn.SetWriteDeadline(time.Time{})
+		}
+		return nil
+	}
+	if !expired {
+		return err
+	}
+	e := NewError(8, 0, "")
+	if !s.partial {
+		s.conn.SetWriteDeadline(time.Now().Add(sendHoldNotifyTimeout))
+		writeMsg(s.conn, e.notification())
+	}
+	return e
+}
+
+// sendHoldExpired aborts the pending write by setting a write deadline in the past.
+func (s *Session) sendHoldExpired() {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if s.writeStart.IsZero() {
+		return
+	}
+	s.sendExpired = true
+	s.conn.SetWriteDeadline(time.Unix(1, 0))
+}
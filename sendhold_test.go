@@ -0,0 +1,62 @@
+package bgp
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSendHoldTimer(t *testing.T) {
+	c := &fakeClock{}
+	p1, p2 := net.Pipe()
+	defer p2.Close()
+	s := &Session{AS: 65000, BGPIdentifier: net.IPv4(10, 0, 0, 1), Clock: c, conn: p1}
+
+	errc := make(chan error)
+	go func() { errc <- s.WriteMsg(&Keepalive{}) }()
+	// Wait until the write blocks, the peer does not read.
+	for s.SendHoldStats().Blocked == 0 {
+		c.Advance(time.Second)
+	}
+	c.Advance(minSendHoldTime)
+
+	m, err := readMsg(p2)
+	if err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if n, ok := m.(*Notification); !ok || n.ErrorCode != 8 {
+		t.Fatalf("expected send hold timer NOTIFICATION, got %v", m)
+	}
+	if err := <-errc; !errors.Is(err, ErrSendHoldTimer) {
+		t.Fatalf("expected send hold timer expired, got %v", err)
+	}
+	if st := s.SendHoldStats(); st.MaxBlocked <= minSendHoldTime || st.Writes != 0 || st.SendHoldTime != minSendHoldTime {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
+
+func TestShutdownBlockedWrite(t *testing.T) {
+	c := &fakeClock{}
+	p1, p2 := net.Pipe()
+	defer p2.Close()
+	s := &Session{AS: 65000, BGPIdentifier: net.IPv4(10, 0, 0, 1), Clock: c, conn: p1}
+
+	errc := make(chan error)
+	go func() { errc <- s.WriteMsg(&Keepalive{}) }()
+	// Read part of the KEEPALIVE, the rest of the write blocks.
+	buf := make([]byte, 5)
+	if _, err := p2.Read(buf); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if err := s.Shutdown("bye"); err != nil {
+		t.Fatalf("expected shutdown, got %v", err)
+	}
+	if err := <-errc; err == nil {
+		t.Fatal("expected the blocked write to fail")
+	}
+	// No NOTIFICATION may follow the partial KEEPALIVE.
+	if n, err := p2.Read(buf); n != 0 || err == nil {
+		t.Fatalf("expected closed connection, got %d bytes", n)
+	}
+}
@@ -0,0 +1,315 @@
+package bgp
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Port is the TCP port BGP uses.
+const Port = 179
+
+// connectRetryTime is the default time between connection attempts to an active neighbor.
+const connectRetryTime = 120 * time.Second
+
+// ErrServerClosed is returned by Serve after Close is called.
+var ErrServerClosed = errors.New("bgp: server closed")
+
+// Neighbor is a configured peer.
+type Neighbor struct {
+	Address net.IP
+	Port    int // If zero, Port is used.
+	// Passive neighbors are not connected to, connections are only accepted from them.
+	Passive bool
+	// Session is the template for the sessions with the neighbor.
+	Session *Session
+
+	mu      sync.Mutex
+	backoff Backoff
+}
+
+// DynamicNeighbors accepts connections from all peers in a prefix, without configuring
+// each of them. Sessions are created on demand from the template in Session.
+type DynamicNeighbors struct {
+	Prefix Prefix
+	// AS, if not empty, holds the AS numbers the peers may use.
+	AS      []uint32
+	Session *Session
+}
+
+// Server accepts connections from neighbors and connects to the neighbors that are not
+// passive, and establishes sessions with them. Connections from addresses that are not
+// a neighbor and are not covered by dynamic neighbors are rejected.
+type Server struct {
+	Neighbors []*Neighbor
+	Dynamic   []*DynamicNeighbors
+	// Handler is called for every established session and owns it: it should read from
+	// the session until it ends, possibly from another goroutine. For active neighbors
+	// a new connection is made after the session ends, not when Handler returns. If
+	// nil, all messages are read and discarded.
+	Handler func(*Session)
+	// Dial is used to connect to neighbors, if nil net.Dial is used.
+	Dial func(network, address string) (net.Conn, error)
+	// ConnectRetryTime is the time between connection attempts to active neighbors, if
+	// zero two minutes is used.
+	ConnectRetryTime time.Duration
+	// DampPeerOscillations doubles the time between connection attempts for every
+	// connection attempt or session that fails in a row, up to MaxIdleHoldTime.
+	DampPeerOscillations bool
+	// MaxIdleHoldTime is the longest time between connection attempts, if zero one
+	// hour is used.
+	MaxIdleHoldTime time.Duration
+	// ErrorLog, if not nil, is used to log connections and sessions that fail.
+	ErrorLog *log.Logger
+	// Clock is used for the time between connection attempts. If nil the system clock
+	// is used.
+	Clock Clock
+
+	collisions Collisions
+	once       sync.Once
+	done       chan struct{}
+	wg         sync.WaitGroup
+
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool // Connections of sessions being established.
+	sessions  map[*Session]bool // Established sessions.
+}
+
+func (srv *Server) init() {
+	srv.once.Do(func() {
+		srv.done = make(chan struct{})
+		srv.listeners = map[net.Listener]bool{}
+		srv.conns = map[net.Conn]bool{}
+		srv.sessions = map[*Session]bool{}
+		for _, n := range srv.Neighbors {
+			if !n.Passive {
+				srv.wg.Add(1)
+				go srv.connect(n)
+			}
+		}
+	})
+}
+
+// Serve accepts connections on l. The first call to Serve also starts connecting to the
+// active neighbors. Serve always returns a non-nil error, after Close ErrServerClosed.
+func (srv *Server) Serve(l net.Listener) error {
+	srv.init()
+	srv.mu.Lock()
+	if srv.closed() {
+		srv.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	srv.listeners[l] = true
+	srv.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if srv.closed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		srv.wg.Add(1)
+		go srv.accept(conn)
+	}
+}
+
+// Close stops accepting and making connections and closes all sessions with a Cease
+// NOTIFICATION.
+func (srv *Server) Close() error {
+	srv.init()
+	srv.mu.Lock()
+	if srv.closed() {
+		srv.mu.Unlock()
+		return nil
+	}
+	close(srv.done)
+	var (
+		listeners = srv.listeners
+		conns     = srv.conns
+		sessions  = srv.sessions
+	)
+	srv.listeners, srv.conns, srv.sessions = nil, nil, nil
+	srv.mu.Unlock()
+
+	for l := range listeners {
+		l.Close()
+	}
+	// Closing the connection aborts establishing the session.
+	for conn := range conns {
+		conn.Close()
+	}
+	for s := range sessions {
+		s.Close()
+	}
+	srv.wg.Wait()
+	return nil
+}
+
+func (srv *Server) closed() bool {
+	select {
+	case <-srv.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// accept establishes a session on the inbound connection conn.
+func (srv *Server) accept(conn net.Conn) {
+	defer srv.wg.Done()
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	s := srv.newSession(net.ParseIP(host))
+	if s == nil {
+		srv.logf("bgp: rejected connection from %s", conn.RemoteAddr())
+		writeMsg(conn, NewError(6, 5, "").notification())
+		conn.Close()
+		return
+	}
+	if s.neighbor != nil && s.neighbor.heldDown(srv.clock().Now()) {
+		srv.logf("bgp: rejected connection from %s: held down after exceeding a prefix limit", conn.RemoteAddr())
+		writeMsg(conn, NewError(6, 5, "").notification())
+		conn.Close()
+		return
+	}
+	s.Inbound = true
+	srv.run(s, conn)
+}
+
+// connect keeps connecting to the active neighbor n, until the server is closed.
+func (srv *Server) connect(n *Neighbor) {
+	defer srv.wg.Done()
+	port := n.Port
+	if port == 0 {
+		port = Port
+	}
+	addr := net.JoinHostPort(n.Address.String(), strconv.Itoa(port))
+	for !srv.closed() {
+		if d := n.Backoff().HoldDown.Sub(srv.clock().Now()); d > 0 {
+			if !srv.wait(d) {
+				return
+			}
+			continue
+		}
+		n.connecting()
+		dial := srv.Dial
+		if dial == nil {
+			dial = net.Dial
+		}
+		var up time.Duration
+		conn, err := dial("tcp", addr)
+		if err != nil {
+			srv.logf("bgp: connecting to %s: %s", addr, err)
+		} else {
+			s := n.Session.new()
+			s.neighbor = n
+			up, err = srv.run(s, conn)
+		}
+		if !srv.wait(srv.retry(n, up, err)) {
+			return
+		}
+	}
+}
+
+// run establishes s on conn and hands it to the handler. It returns how long the session
+// was established and the error that ended it.
+func (srv *Server) run(s *Session, conn net.Conn) (time.Duration, error) {
+	s.Collisions = &srv.collisions
+	srv.mu.Lock()
+	if srv.closed() {
+		srv.mu.Unlock()
+		conn.Close()
+		return 0, ErrServerClosed
+	}
+	srv.conns[conn] = true
+	srv.mu.Unlock()
+
+	err := s.Establish(conn)
+	srv.mu.Lock()
+	delete(srv.conns, conn)
+	if err == nil && srv.closed() {
+		srv.mu.Unlock()
+		s.Close()
+		return 0, ErrServerClosed
+	}
+	if err == nil {
+		srv.sessions[s] = true
+	}
+	srv.mu.Unlock()
+	if err != nil {
+		srv.logf("bgp: session with %s: %s", conn.RemoteAddr(), err)
+		return 0, err
+	}
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.sessions, s)
+		srv.mu.Unlock()
+	}()
+	start := srv.clock().Now()
+	if srv.Handler == nil {
+		for {
+			if m, _ := s.ReadMsg(); m == nil {
+				break
+			}
+		}
+	} else {
+		srv.Handler(s)
+		<-s.Done()
+	}
+	err = s.ended()
+	srv.logf("bgp: session with %s: %v", conn.RemoteAddr(), err)
+	srv.holdDown(s)
+	return srv.clock().Now().Sub(start), err
+}
+
+// newSession returns a new session for a connection from ip, or nil if ip is not a
+// neighbor.
+func (srv *Server) newSession(ip net.IP) *Session {
+	for _, n := range srv.Neighbors {
+		if n.Address.Equal(ip) {
+			s := n.Session.new()
+			s.neighbor = n
+			return s
+		}
+	}
+	for _, d := range srv.Dynamic {
+		if (*net.IPNet)(&d.Prefix).Contains(ip) {
+			s := d.Session.new()
+			s.AllowedPeerAS = d.AS
+			return s
+		}
+	}
+	return nil
+}
+
+// wait waits for d and returns false if the server is closed in the mean time.
+func (srv *Server) wait(d time.Duration) bool {
+	c := make(chan struct{})
+	t := srv.clock().AfterFunc(d, func() { close(c) })
+	defer t.Stop()
+	select {
+	case <-c:
+		return true
+	case <-srv.done:
+		return false
+	}
+}
+
+func (srv *Server) clock() Clock {
+	if srv.Clock == nil {
+		return systemClock{}
+	}
+	return srv.Clock
+}
+
+func (srv *Server) logf(format string, v ...interface{}) {
+	if srv.ErrorLog != nil {
+		srv.ErrorLog.Printf(format, v...)
+	}
+}
@@ -0,0 +1,154 @@
+package bgp
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerDynamicNeighbors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	_, p, _ := net.ParseCIDR("127.0.0.0/8")
+	sessions := make(chan *Session)
+	srv := &Server{
+		Dynamic: []*DynamicNeighbors{{Prefix: Prefix(*p), AS: []uint32{65001},
+			Session: &Session{AS: 65000, BGPIdentifier: net.IPv4(10, 0, 0, 1), HoldTime: 90}}},
+		Handler: func(s *Session) {
+			sessions <- s
+			s.ReadMsg()
+		},
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	// An active neighbor of a second server connects to the first.
+	port := l.Addr().(*net.TCPAddr).Port
+	active := &Server{
+		Neighbors: []*Neighbor{{Address: net.IPv4(127, 0, 0, 1), Port: port,
+			Session: &Session{AS: 65001, BGPIdentifier: net.IPv4(10, 0, 0, 2), HoldTime: 90}}},
+		Handler: func(s *Session) {
+			sessions <- s
+			s.ReadMsg()
+		},
+	}
+	l1, _ := net.Listen("tcp", "127.0.0.1:0")
+	go active.Serve(l1)
+	for i := 0; i < 2; i++ {
+		s := <-sessions
+		if s.State().AS != 65000 && s.State().AS != 65001 {
+			t.Fatalf("unexpected peer AS: %d", s.State().AS)
+		}
+	}
+	active.Close()
+
+	// AS not in the allow-list.
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	s := &Session{AS: 65002, BGPIdentifier: net.IPv4(10, 0, 0, 3), HoldTime: 90}
+	if err := s.Establish(conn); !errors.Is(err, ErrBadPeerAS) {
+		t.Fatalf("expected bad peer AS, got %v", err)
+	}
+}
+
+func TestServerBackoff(t *testing.T) {
+	// Find a port nobody listens on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	c := &fakeClock{}
+	n := &Neighbor{Address: net.IPv4(127, 0, 0, 1), Port: port,
+		Session: &Session{AS: 65001, BGPIdentifier: net.IPv4(10, 0, 0, 2)}}
+	srv := &Server{Neighbors: []*Neighbor{n}, Clock: c, ConnectRetryTime: time.Second, DampPeerOscillations: true}
+	l, _ = net.Listen("tcp", "127.0.0.1:0")
+	go srv.Serve(l)
+	defer srv.Close()
+
+	for failures := 1; failures <= 3; failures++ {
+		for n.Backoff().Failures < failures || c.active() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		b := n.Backoff()
+		max := time.Second << (failures - 1)
+		if b.Failures != failures || b.Delay < max*3/4 || b.Delay > max || b.LastError == nil {
+			t.Fatalf("unexpected backoff after %d failures: %+v", failures, b)
+		}
+		c.Advance(b.Delay)
+	}
+}
+
+func TestServerCloseEstablishing(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	_, p, _ := net.ParseCIDR("127.0.0.0/8")
+	srv := &Server{Dynamic: []*DynamicNeighbors{{Prefix: Prefix(*p),
+		Session: &Session{AS: 65000, BGPIdentifier: net.IPv4(10, 0, 0, 1), HoldTime: 90}}}}
+	go srv.Serve(l)
+
+	// The peer never sends its OPEN.
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	defer conn.Close()
+	if _, err := readMsg(conn); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+
+	done := make(chan struct{})
+	go func() { srv.Close(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocks on a session being established")
+	}
+}
+
+func TestServerHandlerReturns(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	_, p, _ := net.ParseCIDR("127.0.0.0/8")
+	sessions := make(chan *Session, 1)
+	srv := &Server{
+		Dynamic: []*DynamicNeighbors{{Prefix: Prefix(*p),
+			Session: &Session{AS: 65000, BGPIdentifier: net.IPv4(10, 0, 0, 1), HoldTime: 90}}},
+		// The session is handed off, Handler returns while it is established.
+		Handler: func(s *Session) { sessions <- s },
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	peer := &Session{AS: 65001, BGPIdentifier: net.IPv4(10, 0, 0, 2), HoldTime: 90}
+	if err := peer.Establish(conn); err != nil {
+		t.Fatalf("establish failed: %s", err)
+	}
+	defer peer.Close()
+	s := <-sessions
+	// Give run the chance to wrongly end the session.
+	time.Sleep(10 * time.Millisecond)
+	srv.mu.Lock()
+	registered := srv.sessions[s]
+	srv.mu.Unlock()
+	if !registered || s.ended() != nil {
+		t.Fatal("session ended when Handler returned")
+	}
+	s.Close()
+	<-s.Done()
+}
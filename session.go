@@ -0,0 +1,526 @@
+package bgp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Session is a BGP session with a single peer. It takes care of the OPEN exchange and
+// applies the rules for sending and receiving UPDATEs that follow from the negotiated
+// state. AS and BGPIdentifier must be set before calling Establish. The peer must
+// support 4-octet AS numbers, RFC 6793.
+type Session struct {
+	AS            uint32 // Local AS number.
+	BGPIdentifier net.IP // Local BGP identifier, must be an IPv4 address.
+	// HoldTime is the hold time in seconds we advertise, zero disables the hold timer
+	// and KEEPALIVEs. It must not be 1 or 2.
+	HoldTime uint16
+	// PeerAS, if not zero, is the AS number the peer must use.
+	PeerAS uint32
+	// AllowedPeerAS, if not empty, holds the AS numbers the peer may use.
+	AllowedPeerAS []uint32
+	// Role is our BGP Role, see RFC 9234. If set, the Role capability is advertised
+	// and OTC attributes are handled when sending and receiving UPDATEs.
+	Role Role
+	// StrictRole closes the session when the peer does not advertise a role.
+	StrictRole bool
+	// Hostname and DomainName are advertised in the FQDN capability, when
+	// Hostname is not empty.
+	Hostname   string
+	DomainName string
+	// SoftwareVersion, if not empty, is advertised in the software version capability.
+	SoftwareVersion string
+	// GracefulRestart, if not nil, is advertised in the graceful restart capability.
+	GracefulRestart *GracefulRestart
+	// HardAdminReset sends an Administrative Reset as a Hard Reset, so the peer flushes
+	// our routes. By default the peer keeps them, RFC 8538, Section 5.
+	HardAdminReset bool
+	// AddPath, if not empty, is advertised in the ADD-PATH capability, RFC 7911.
+	AddPath []AddPathFamily
+	// ExtendedMessage advertises the extended message capability, RFC 8654.
+	ExtendedMessage bool
+	// SendHoldTime is the time a write may block before the session is closed, RFC 9687.
+	// If zero, the larger of eight minutes and twice the negotiated hold time is used.
+	SendHoldTime time.Duration
+	// Clock is used for the session's timers. If nil the system clock is used.
+	Clock Clock
+	// Collisions, if not nil, is used to detect connection collisions with other
+	// sessions of this speaker.
+	Collisions *Collisions
+	// Inbound is true when the connection was accepted from the peer, it is used
+	// to resolve connection collisions.
+	Inbound bool
+	// PrefixLimits limits the number of prefixes the peer may announce, per family.
+	// They are enforced by an AdjRIBIn with this session set.
+	PrefixLimits []PrefixLimit
+
+	conn     net.Conn
+	neighbor *Neighbor // The configured neighbor this session was set up for.
+	state    State
+	pathIDs  map[Family]bool // Families in which received NLRI have path identifiers.
+	disabled map[Family]bool // Families disabled because of errors, RFC 7606.
+
+	writeMu sync.Mutex // Serializes writes to conn, it is held while a write blocks.
+	partial bool       // A write was aborted part-way, protected by writeMu.
+
+	mu        sync.Mutex // Protects the fields below, it is never held while blocked.
+	hold      Timer
+	holdTime  time.Duration
+	keepalive Timer
+	err       error         // The error that ended the session.
+	done      chan struct{} // Closed when the session ends.
+	exceeded  *PrefixLimit  // The prefix limit that ended the session.
+
+	sendMu      sync.Mutex // Protects the fields below, it is never held while blocked.
+	sendHold    Timer
+	sendExpired bool
+	writeStart  time.Time // Start of the pending write, zero if not writing.
+	sendStats   SendHoldStats
+}
+
+// new returns a new session with the configuration of s.
+func (s *Session) new() *Session {
+	return &Session{
+		AS:              s.AS,
+		BGPIdentifier:   s.BGPIdentifier,
+		HoldTime:        s.HoldTime,
+		PeerAS:          s.PeerAS,
+		AllowedPeerAS:   s.AllowedPeerAS,
+		Role:            s.Role,
+		StrictRole:      s.StrictRole,
+		Hostname:        s.Hostname,
+		DomainName:      s.DomainName,
+		SoftwareVersion: s.SoftwareVersion,
+		GracefulRestart: s.GracefulRestart,
+		HardAdminReset:  s.HardAdminReset,
+		AddPath:         s.AddPath,
+		ExtendedMessage: s.ExtendedMessage,
+		SendHoldTime:    s.SendHoldTime,
+		Clock:           s.Clock,
+		Collisions:      s.Collisions,
+		Inbound:         s.Inbound,
+		PrefixLimits:    s.PrefixLimits,
+	}
+}
+
+// State is the state negotiated with the peer during the OPEN exchange.
+type State struct {
+	AS            uint32 // AS number of the peer.
+	BGPIdentifier net.IP // BGP identifier of the peer.
+	HoldTime      uint16 // Negotiated hold time: the smaller of ours and the peer's.
+	Role          Role   // Role advertised by the peer, RoleNone if it did not.
+
+	// Hostname, DomainName and SoftwareVersion are taken from the FQDN and software
+	// version capabilities, they are empty if the peer did not advertise them.
+	Hostname        string
+	DomainName      string
+	SoftwareVersion string
+
+	// GracefulRestart holds the graceful restart capability of the peer, or nil.
+	GracefulRestart *GracefulRestart
+	// AddPath holds the families in which multiple paths are received from and sent to
+	// the peer: both sides advertised it in the ADD-PATH capability.
+	AddPath []AddPathFamily
+	// Families holds the families the peer advertised in multiprotocol capabilities.
+	Families []Family
+	// ExtendedMessage is true if both sides advertised the extended message capability,
+	// messages of up to MaxExtendedSize bytes are then sent and received, RFC 8654.
+	ExtendedMessage bool
+}
+
+// String returns a one line description of the state, suitable for logging.
+func (s State) String() string {
+	str := fmt.Sprintf("AS %d, identifier %s, hold time %d", s.AS, s.BGPIdentifier, s.HoldTime)
+	if s.Role != RoleNone {
+		str += ", role " + s.Role.String()
+	}
+	if s.Hostname != "" {
+		str += ", hostname " + s.Hostname
+		if s.DomainName != "" {
+			str += "." + s.DomainName
+		}
+	}
+	if s.SoftwareVersion != "" {
+		str += ", software " + strconv.Quote(s.SoftwareVersion)
+	}
+	if s.GracefulRestart != nil {
+		str += ", graceful restart " + strconv.Itoa(int(s.GracefulRestart.Time)) + "s"
+	}
+	return str
+}
+
+// Establish sends an OPEN on conn and waits for the peer's OPEN and KEEPALIVE. If
+// the peer's OPEN is not acceptable a NOTIFICATION is sent and an error is returned,
+// in either case conn is closed on error. Once established, KEEPALIVEs are sent and
+// the hold timer runs until the session ends.
+func (s *Session) Establish(conn net.Conn) error {
+	s.conn = conn
+	if s.BGPIdentifier.To4() == nil {
+		return s.close(&Error{Err: "local BGP identifier must be an IPv4 address"})
+	}
+	if s.HoldTime == 1 || s.HoldTime == 2 {
+		return s.close(&Error{Err: "local hold time must be zero or at least three seconds"})
+	}
+	s.startHold(openHoldTime)
+	if err := s.write(s.open()); err != nil {
+		return s.close(err)
+	}
+
+	m, err := s.read()
+	if m == nil {
+		return err
+	}
+	o, ok := m.(*Open)
+	if !ok {
+		return s.notify(NewError(5, 1, fmt.Sprintf("expected OPEN, got %T", m)))
+	}
+	if err := s.negotiate(o); err != nil {
+		return s.notify(err.(*Error))
+	}
+	if err := s.resolveCollision(); err != nil {
+		return err
+	}
+	s.startHold(time.Duration(s.state.HoldTime) * time.Second)
+	if err := s.write(&Keepalive{}); err != nil {
+		return s.close(err)
+	}
+
+	m, err = s.read()
+	if m == nil {
+		return err
+	}
+	if _, ok := m.(*Keepalive); !ok {
+		return s.notify(NewError(5, 2, fmt.Sprintf("expected KEEPALIVE, got %T", m)))
+	}
+	if s.Collisions != nil {
+		s.Collisions.established(s)
+	}
+	s.startKeepalive()
+	return nil
+}
+
+// State returns the negotiated state of the session.
+func (s *Session) State() State { return s.state }
+
+// ReadMsg reads the next message from the peer. A NOTIFICATION from the peer is returned
+// as an error. Received UPDATEs have the route leak prevention rules applied. An UPDATE
+// with errors that do not need a session reset (RFC 7606) is returned together with an
+// *UpdateError, the session stays up. When the session has ended, for instance because
+// the hold timer expired, the error that ended it is returned.
+func (s *Session) ReadMsg() (Msg, error) {
+	m, err := s.read()
+	if m == nil {
+		return nil, err
+	}
+	if u, ok := m.(*Update); ok {
+		u.removeFamilies(s.disabled)
+		s.ingress(u)
+	}
+	return m, err
+}
+
+// WriteMsg sends m to the peer. UPDATEs have the route leak prevention rules applied,
+// which may lead to nothing being sent at all. WriteMsg may be called concurrently
+// with ReadMsg.
+func (s *Session) WriteMsg(m Msg) error {
+	if u, ok := m.(*Update); ok {
+		if u = s.egress(u); u == nil {
+			return nil
+		}
+		m = u
+	}
+	if err := s.write(m); err != nil {
+		return s.close(err)
+	}
+	return nil
+}
+
+// Close sends a Cease NOTIFICATION with subcode Administrative Shutdown to the peer
+// and closes the connection.
+func (s *Session) Close() error { return s.Shutdown("") }
+
+// Shutdown is like Close, but sends communication as the reason for the shutdown,
+// see RFC 9003. The communication is truncated to 255 bytes. When graceful restart
+// with notification support is negotiated, this is sent as a Hard Reset.
+func (s *Session) Shutdown(communication string) error {
+	return s.cease(2, communication)
+}
+
+// AdminReset sends a Cease NOTIFICATION with subcode Administrative Reset and
+// communication as the reason, and closes the connection. The peer is expected to
+// reconnect. It is only sent as a Hard Reset when HardAdminReset is set.
+func (s *Session) AdminReset(communication string) error {
+	return s.cease(4, communication)
+}
+
+// cease ends the session with a Cease NOTIFICATION. If the session has already
+// ended, the error that ended it is returned.
+func (s *Session) cease(subcode uint8, communication string) error {
+	n, err := s.wrapNotification(&Notification{ErrorCode: 6, ErrorSubcode: subcode, Communication: communication}, nil)
+	if !s.end(n, err) {
+		return s.ended()
+	}
+	return nil
+}
+
+// read reads a message from the connection. Errors in the received message are
+// sent as a NOTIFICATION to the peer, a NOTIFICATION from the peer is returned as
+// an error. In both cases the connection is closed. UPDATE errors that do not need a
+// session reset are returned together with the message.
+func (s *Session) read() (Msg, error) {
+	size := MaxSize
+	if s.state.ExtendedMessage {
+		size = MaxExtendedSize
+	}
+	m, err := readAddPathMsg(s.conn, s.pathIDs, size)
+	if err != nil {
+		switch e := err.(type) {
+		case *UpdateError:
+			if e.Action != SessionReset {
+				s.resetHold()
+				s.disable(e.Disabled)
+				return m, err
+			}
+			s.notify(e.notification())
+			return nil, e
+		case *Error:
+			return nil, s.notify(e)
+		}
+		return nil, s.close(err)
+	}
+	s.resetHold()
+	if n, ok := m.(*Notification); ok {
+		return nil, s.close(notificationError(n))
+	}
+	return m, nil
+}
+
+// write writes m to the connection and restarts the keepalive timer. Writes are
+// serialized with s.writeMu, s.mu is not held while the write blocks.
+func (s *Session) write(m Msg) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.ended(); err != nil {
+		return err
+	}
+	if err := s.writeConn(m); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keepalive != nil && s.err == nil {
+		s.keepalive.Reset(s.keepaliveInterval())
+	}
+	return nil
+}
+
+// disable disables the families in fams for the rest of the session.
+func (s *Session) disable(fams []Family) {
+	for _, f := range fams {
+		if s.disabled == nil {
+			s.disabled = map[Family]bool{}
+		}
+		s.disabled[f] = true
+	}
+}
+
+// notify sends e as a NOTIFICATION to the peer, closes the connection and returns the
+// error that was sent: e or a Hard Reset wrapping e. If the session has already ended,
+// nothing is sent and the error that ended it is returned.
+func (s *Session) notify(e *Error) error {
+	n, err := s.wrapNotification(e.notification(), e)
+	if !s.end(n, err) {
+		return s.ended()
+	}
+	return err
+}
+
+// end ends the session with err, sends n and closes the connection. A pending write
+// is given sendHoldNotifyTimeout to complete, n is not sent when the write was
+// aborted part-way, as that would corrupt the stream. End returns false, without
+// sending n, if the session has already ended.
+func (s *Session) end(n *Notification, err error) bool {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return false
+	}
+	s.err = err
+	s.stopTimers()
+	close(s.doneLocked())
+	s.mu.Unlock()
+
+	if !s.writeMu.TryLock() {
+		s.conn.SetWriteDeadline(time.Now().Add(sendHoldNotifyTimeout))
+		s.writeMu.Lock()
+	}
+	if !s.partial {
+		s.conn.SetWriteDeadline(time.Now().Add(sendHoldNotifyTimeout))
+		writeMsg(s.conn, n)
+	}
+	s.writeMu.Unlock()
+	s.shutdown()
+	return true
+}
+
+// ended returns the error that ended the session, or nil if it has not ended.
+func (s *Session) ended() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Done returns a channel that is closed when the session ends.
+func (s *Session) Done() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.doneLocked()
+}
+
+// doneLocked returns the channel closed when the session ends. The caller must hold s.mu.
+func (s *Session) doneLocked() chan struct{} {
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+	return s.done
+}
+
+// close ends the session with err: the timers are stopped and the connection is
+// closed. If the session has already ended, the error that ended it is returned,
+// otherwise err.
+func (s *Session) close(err error) error {
+	s.mu.Lock()
+	if s.err != nil {
+		defer s.mu.Unlock()
+		return s.err
+	}
+	s.err = err
+	s.stopTimers()
+	close(s.doneLocked())
+	s.mu.Unlock()
+	s.shutdown()
+	return err
+}
+
+// shutdown closes the connection, which aborts pending reads and writes.
+func (s *Session) shutdown() {
+	s.conn.Close()
+	if s.Collisions != nil {
+		s.Collisions.remove(s)
+	}
+}
+
+// open returns the OPEN message we send to the peer.
+func (s *Session) open() *Open {
+	o := &Open{HoldTime: s.HoldTime, BGPIdentifier: s.BGPIdentifier.To4()}
+	if s.AS <= 0xffff {
+		o.AS = uint16(s.AS)
+	}
+	c := &Capability{}
+	c.Append(CAP_ROUTE_REFRESH)
+	c.Append(CAP_AS4, int(s.AS))
+	if s.Role != RoleNone {
+		c.Append(CAP_ROLE, s.Role)
+	}
+	if s.Hostname != "" {
+		c.Append(CAP_FQDN, s.Hostname, s.DomainName)
+	}
+	if s.SoftwareVersion != "" {
+		c.Append(CAP_SOFTWARE_VERSION, s.SoftwareVersion)
+	}
+	if s.GracefulRestart != nil {
+		c.Append(CAP_GRACEFUL_RESTART, s.GracefulRestart)
+	}
+	if len(s.AddPath) > 0 {
+		c.Append(CAP_ADD_PATH, s.AddPath)
+	}
+	if s.ExtendedMessage {
+		c.Append(CAP_EXTENDED_MESSAGE)
+	}
+	o.Parameters = make([]Parameter, 1)
+	o.Parameters[0].Append(CAP, c)
+	return o
+}
+
+// negotiate checks the OPEN o received from the peer and sets the session state.
+func (s *Session) negotiate(o *Open) error {
+	if o.Version != Version {
+		e := NewError(2, 1, fmt.Sprintf("version %d", o.Version))
+		e.Data = []byte{0, Version} // The largest version we support.
+		return e
+	}
+	if o.HoldTime == 1 || o.HoldTime == 2 {
+		return NewError(2, 6, fmt.Sprintf("hold time %d", o.HoldTime))
+	}
+	s.state = State{AS: uint32(o.AS), BGPIdentifier: o.BGPIdentifier, HoldTime: s.HoldTime}
+	if o.HoldTime < s.HoldTime {
+		s.state.HoldTime = o.HoldTime
+	}
+	as4 := false
+	for _, c := range o.capabilities() {
+		switch c.t {
+		case CAP_MULTI_PROTOCOL:
+			s.state.Families = append(s.state.Families, Family{binary.BigEndian.Uint16(c.d), c.d[3]})
+		case CAP_EXTENDED_MESSAGE:
+			s.state.ExtendedMessage = s.ExtendedMessage
+		case CAP_AS4:
+			as4 = true
+			s.state.AS = binary.BigEndian.Uint32(c.d)
+		case CAP_ROLE:
+			s.state.Role = roleFromWire(c.d[0])
+		case CAP_FQDN:
+			var n int
+			s.state.Hostname, n = setString(c.d)
+			s.state.DomainName, _ = setString(c.d[n:])
+		case CAP_SOFTWARE_VERSION:
+			s.state.SoftwareVersion, _ = setString(c.d)
+		case CAP_GRACEFUL_RESTART:
+			s.state.GracefulRestart = &GracefulRestart{}
+			s.state.GracefulRestart.setBytes(c.d)
+		case CAP_ADD_PATH:
+			peer, _ := setAddPath(c.d)
+			s.state.AddPath = negotiateAddPath(s.AddPath, peer)
+		}
+	}
+	s.pathIDs = s.state.receivePathIDs()
+	// AS_PATH and AGGREGATOR are only encoded with 4-octet AS numbers, there is no
+	// support for AS4_PATH and AS4_AGGREGATOR.
+	if !as4 {
+		e := NewError(2, 7, "peer did not advertise 4-octet AS numbers")
+		e.Data = []byte{CAP_AS4, 4}
+		e.Data = binary.BigEndian.AppendUint32(e.Data, s.AS)
+		return e
+	}
+	if s.PeerAS != 0 && s.PeerAS != s.state.AS {
+		return NewError(2, 2, fmt.Sprintf("expected AS %d, got %d", s.PeerAS, s.state.AS))
+	}
+	if len(s.AllowedPeerAS) > 0 && !slices.Contains(s.AllowedPeerAS, s.state.AS) {
+		return NewError(2, 2, fmt.Sprintf("AS %d not allowed", s.state.AS))
+	}
+	// The identifier must not be zero, and must differ from ours within an AS, RFC 6286.
+	if s.state.BGPIdentifier.Equal(net.IPv4zero) {
+		return NewError(2, 3, "identifier 0.0.0.0")
+	}
+	if s.state.AS == s.AS && s.state.BGPIdentifier.Equal(s.BGPIdentifier) {
+		return NewError(2, 3, fmt.Sprintf("identifier %s is our own", s.state.BGPIdentifier))
+	}
+
+	if s.Role == RoleNone {
+		return nil
+	}
+	if s.state.Role == RoleNone {
+		if s.StrictRole {
+			return NewError(2, 11, "peer did not advertise a role")
+		}
+		return nil
+	}
+	if rolePairs[s.Role] != s.state.Role {
+		return NewError(2, 11, fmt.Sprintf("local role %s, peer role %s", s.Role, s.state.Role))
+	}
+	return nil
+}
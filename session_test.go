@@ -0,0 +1,282 @@
+package bgp
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// establish sets up the sessions a and b over a TCP connection on the loopback interface.
+func establish(t *testing.T, a, b *Session) (error, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	defer l.Close()
+
+	errc := make(chan error)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			errc <- err
+			return
+		}
+		errc <- b.Establish(conn)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	erra := a.Establish(conn)
+	return erra, <-errc
+}
+
+func TestSessionRoleMismatch(t *testing.T) {
+	a := &Session{AS: 65000, BGPIdentifier: net.IPv4(10, 0, 0, 1), Role: RoleCustomer}
+	b := &Session{AS: 65001, BGPIdentifier: net.IPv4(10, 0, 0, 2), Role: RolePeer}
+	erra, errb := establish(t, a, b)
+	if erra == nil || errb == nil {
+		t.Fatalf("expected role mismatch, got %v and %v", erra, errb)
+	}
+	if e, ok := erra.(*Error); !ok || e.Code != 2 || e.Subcode != 11 {
+		t.Fatalf("expected role mismatch, got %v", erra)
+	}
+}
+
+func TestSessionUnknownRole(t *testing.T) {
+	s := &Session{AS: 65000, BGPIdentifier: net.IPv4(10, 0, 0, 1), Role: RolePeer}
+	o := &Open{Version: Version, AS: 65001, BGPIdentifier: net.IPv4(10, 0, 0, 2), Parameters: make([]Parameter, 1)}
+	o.Parameters[0].Append(CAP, &Capability{data: []typeData{{CAP_AS4, []byte{0, 0, 0xfd, 0xe9}}, {CAP_ROLE, []byte{255}}}})
+	err := s.negotiate(o)
+	if !errors.Is(err, ErrRoleMismatch) {
+		t.Fatalf("expected role mismatch, got %v", err)
+	}
+	if s.state.Role != RoleUnknown {
+		t.Fatalf("expected unknown role, got %s", s.state.Role)
+	}
+}
+
+func TestSessionNoAS4(t *testing.T) {
+	s := &Session{AS: 65000, BGPIdentifier: net.IPv4(10, 0, 0, 1)}
+	o := &Open{Version: Version, AS: 65001, BGPIdentifier: net.IPv4(10, 0, 0, 2), Parameters: make([]Parameter, 1)}
+	o.Parameters[0].Append(CAP, &Capability{data: []typeData{{CAP_ROUTE_REFRESH, nil}}})
+	err := s.negotiate(o)
+	if !errors.Is(err, ErrUnsupportedCapability) {
+		t.Fatalf("expected unsupported capability, got %v", err)
+	}
+	if d := err.(*Error).Data; len(d) != 6 || d[0] != CAP_AS4 || d[1] != 4 {
+		t.Fatalf("expected AS4 capability in data, got %v", d)
+	}
+}
+
+func TestSessionBadBGPIdentifier(t *testing.T) {
+	for _, tc := range []struct {
+		as  uint32
+		id  net.IP
+		bad bool
+	}{
+		{65001, net.IPv4(0, 0, 0, 0), true},
+		{65000, net.IPv4(10, 0, 0, 1), true},  // iBGP with our identifier.
+		{65001, net.IPv4(10, 0, 0, 1), false}, // eBGP may use our identifier.
+		{65000, net.IPv4(10, 0, 0, 2), false},
+	} {
+		s := &Session{AS: 65000, BGPIdentifier: net.IPv4(10, 0, 0, 1)}
+		o := &Open{Version: Version, AS: uint16(tc.as), BGPIdentifier: tc.id, Parameters: make([]Parameter, 1)}
+		c := &Capability{}
+		c.Append(CAP_AS4, int(tc.as))
+		o.Parameters[0].Append(CAP, c)
+		err := s.negotiate(o)
+		if errors.Is(err, ErrBadBGPIdentifier) != tc.bad {
+			t.Errorf("AS %d, identifier %s: expected bad BGP identifier %t, got %v", tc.as, tc.id, tc.bad, err)
+		}
+	}
+}
+
+func TestSessionOnlyToCustomer(t *testing.T) {
+	a := &Session{AS: 65000, BGPIdentifier: net.IPv4(10, 0, 0, 1), Role: RoleProvider}
+	b := &Session{AS: 4200000000, BGPIdentifier: net.IPv4(10, 0, 0, 2), Role: RoleCustomer, StrictRole: true}
+	if erra, errb := establish(t, a, b); erra != nil || errb != nil {
+		t.Fatalf("establish failed: %v, %v", erra, errb)
+	}
+	defer a.Close()
+	if b.State().AS != 65000 || b.State().Role != RoleProvider {
+		t.Fatalf("unexpected state: %+v", b.State())
+	}
+	if a.State().AS != 4200000000 {
+		t.Fatalf("unexpected state: %+v", a.State())
+	}
+
+	_, p, _ := net.ParseCIDR("10.0.0.0/8")
+	u := &Update{ReachabilityInfo: []Prefix{Prefix(*p)}, Attributes: make([]Attribute, 3)}
+	o, nh := Origin(IGP), NextHop(net.IPv4(10, 0, 0, 1))
+	u.Attributes[0].Append(origin, &o)
+	u.Attributes[1].Append(path, &Path{{Type: AS_SEQUENCE, AS: []uint32{65000}}})
+	u.Attributes[2].Append(next_hop, &nh)
+	// Provider to customer: OTC is added with our AS.
+	go a.WriteMsg(u)
+	m, err := b.ReadMsg()
+	if err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	u1 := m.(*Update)
+	if a := findAttr(u1.Attributes, only_to_customer); a == nil || *a.Value().(*OnlyToCustomer) != 65000 {
+		t.Fatalf("expected OTC 65000, got %v", u1.Attributes)
+	}
+
+	// Customer to provider: routes with OTC must not be sent, the provider treats them as a leak.
+	if err := b.WriteMsg(u1); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	if len(u.Attributes) != 3 {
+		t.Fatalf("egress modified the update: %v", u.Attributes)
+	}
+	a.ingress(u1)
+	if len(u1.ReachabilityInfo) != 0 || len(u1.WithdrawnRoutes) != 1 || len(u1.Attributes) != 0 {
+		t.Fatalf("expected leaked route to be withdrawn, got %+v", u1)
+	}
+}
+
+func TestSessionFQDN(t *testing.T) {
+	a := &Session{AS: 65000, BGPIdentifier: net.IPv4(10, 0, 0, 1)}
+	b := &Session{AS: 65001, BGPIdentifier: net.IPv4(10, 0, 0, 2), Hostname: "rtr1", DomainName: "example.net", SoftwareVersion: "bgp/1.0"}
+	if erra, errb := establish(t, a, b); erra != nil || errb != nil {
+		t.Fatalf("establish failed: %v, %v", erra, errb)
+	}
+	defer a.Close()
+	if s := a.State(); s.Hostname != "rtr1" || s.DomainName != "example.net" || s.SoftwareVersion != "bgp/1.0" {
+		t.Fatalf("unexpected state: %+v", s)
+	}
+	if s := b.State(); s.Hostname != "" || s.SoftwareVersion != "" {
+		t.Fatalf("unexpected state: %+v", s)
+	}
+}
+
+func TestSessionHardReset(t *testing.T) {
+	gr := &GracefulRestart{Notification: true, Time: 120, Families: []RestartFamily{{Family: Family{AFI_IP, SAFI_UNICAST}}}}
+	a := &Session{AS: 65000, BGPIdentifier: net.IPv4(10, 0, 0, 1), GracefulRestart: gr}
+	b := &Session{AS: 65001, BGPIdentifier: net.IPv4(10, 0, 0, 2), GracefulRestart: gr}
+	if erra, errb := establish(t, a, b); erra != nil || errb != nil {
+		t.Fatalf("establish failed: %v, %v", erra, errb)
+	}
+	if g := b.State().GracefulRestart; g == nil || !g.Notification || g.Time != 120 || len(g.Families) != 1 {
+		t.Fatalf("unexpected graceful restart state: %+v", g)
+	}
+	// A soft notification keeps the routes.
+	if !b.PreserveRoutes(NewError(4, 0, "")) {
+		t.Fatalf("expected routes to be preserved on hold timer expiry")
+	}
+
+	go a.Shutdown("maintenance")
+	_, err := b.ReadMsg()
+	if !errors.Is(err, ErrHardReset) || !errors.Is(err, ErrAdminShutdown) {
+		t.Fatalf("expected hard reset wrapping administrative shutdown, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "maintenance") {
+		t.Fatalf("expected shutdown communication in error, got %v", err)
+	}
+	if b.PreserveRoutes(err) {
+		t.Fatalf("expected routes to be flushed on hard reset")
+	}
+}
+
+func TestSessionAdminReset(t *testing.T) {
+	gr := &GracefulRestart{Notification: true, Time: 120, Families: []RestartFamily{{Family: Family{AFI_IP, SAFI_UNICAST}}}}
+	for _, hard := range []bool{false, true} {
+		a := &Session{AS: 65000, BGPIdentifier: net.IPv4(10, 0, 0, 1), GracefulRestart: gr, HardAdminReset: hard}
+		b := &Session{AS: 65001, BGPIdentifier: net.IPv4(10, 0, 0, 2), GracefulRestart: gr}
+		if erra, errb := establish(t, a, b); erra != nil || errb != nil {
+			t.Fatalf("establish failed: %v, %v", erra, errb)
+		}
+		go a.AdminReset("")
+		_, err := b.ReadMsg()
+		if !errors.Is(err, ErrAdminReset) || errors.Is(err, ErrHardReset) != hard {
+			t.Fatalf("expected administrative reset, hard reset %t, got %v", hard, err)
+		}
+		if b.PreserveRoutes(err) == hard {
+			t.Fatalf("expected routes to be preserved: %t", !hard)
+		}
+	}
+}
+
+func TestSessionExtendedMessage(t *testing.T) {
+	a := &Session{AS: 65000, BGPIdentifier: net.IPv4(10, 0, 0, 1), ExtendedMessage: true}
+	b := &Session{AS: 65001, BGPIdentifier: net.IPv4(10, 0, 0, 2)}
+	if erra, errb := establish(t, a, b); erra != nil || errb != nil {
+		t.Fatalf("establish failed: %v, %v", erra, errb)
+	}
+	a.Close()
+	if a.State().ExtendedMessage || b.State().ExtendedMessage {
+		t.Fatal("expected no extended messages when only one side advertises them")
+	}
+
+	a = &Session{AS: 65000, BGPIdentifier: net.IPv4(10, 0, 0, 1), ExtendedMessage: true}
+	b = &Session{AS: 65001, BGPIdentifier: net.IPv4(10, 0, 0, 2), ExtendedMessage: true}
+	if erra, errb := establish(t, a, b); erra != nil || errb != nil {
+		t.Fatalf("establish failed: %v, %v", erra, errb)
+	}
+	defer a.Close()
+	if !a.State().ExtendedMessage || !b.State().ExtendedMessage {
+		t.Fatal("expected extended messages")
+	}
+	var routes []*Route
+	for i := 0; i < 2000; i++ {
+		rt := testRoute(0, 65001)
+		rt.Prefix = Prefix{IP: net.IPv4(10, byte(i>>8), byte(i), 0), Mask: net.CIDRMask(24, 32)}
+		routes = append(routes, rt)
+	}
+	ups := packUpdates(ipv4Unicast, nil, routes, MaxExtendedSize, false)
+	if len(ups) != 1 || len(ups[0].bytes()) <= MaxSize {
+		t.Fatalf("expected one UPDATE larger than %d bytes", MaxSize)
+	}
+	go b.WriteMsg(ups[0])
+	m, err := a.ReadMsg()
+	if err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if n := len(m.(*Update).ReachabilityInfo); n != 2000 {
+		t.Fatalf("expected 2000 prefixes, got %d", n)
+	}
+}
+
+func TestSessionAddPath(t *testing.T) {
+	ipv6 := Family{AFI_IP6, SAFI_UNICAST}
+	a := &Session{AS: 65000, BGPIdentifier: net.IPv4(10, 0, 0, 1),
+		AddPath: []AddPathFamily{{Family: ipv4Unicast, Receive: true}, {Family: ipv6, Receive: true}}}
+	b := &Session{AS: 65001, BGPIdentifier: net.IPv4(10, 0, 0, 2),
+		AddPath: []AddPathFamily{{Family: ipv4Unicast, Send: true}, {Family: ipv6, Receive: true}}}
+	if erra, errb := establish(t, a, b); erra != nil || errb != nil {
+		t.Fatalf("establish failed: %v, %v", erra, errb)
+	}
+	defer a.Close()
+	if s := a.State(); len(s.AddPath) != 1 || s.AddPath[0] != (AddPathFamily{Family: ipv4Unicast, Receive: true}) {
+		t.Fatalf("unexpected ADD-PATH state: %+v", s.AddPath)
+	}
+	if !b.State().SendPathIDs(ipv4Unicast) || b.State().SendPathIDs(ipv6) {
+		t.Fatalf("unexpected ADD-PATH state: %+v", b.State().AddPath)
+	}
+
+	u := &Update{ReachabilityInfo: []Prefix{prefix("10.0.0.0/8"), prefix("10.0.0.0/8")}, PathIDs: []uint32{7, 9},
+		WithdrawnRoutes: []Prefix{prefix("10.1.0.0/16")}, WithdrawnPathIDs: []uint32{3}, Attributes: make([]Attribute, 3)}
+	o, nh := Origin(IGP), NextHop(net.IPv4(10, 0, 0, 2))
+	u.Attributes[0].Append(origin, &o)
+	u.Attributes[1].Append(path, &Path{{Type: AS_SEQUENCE, AS: []uint32{65001}}})
+	u.Attributes[2].Append(next_hop, &nh)
+	go b.WriteMsg(u)
+	m, err := a.ReadMsg()
+	if err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	u1 := m.(*Update)
+	if len(u1.ReachabilityInfo) != 2 || len(u1.WithdrawnPathIDs) != 1 || u1.WithdrawnPathIDs[0] != 3 {
+		t.Fatalf("unexpected UPDATE: %+v", u1)
+	}
+
+	r := &AdjRIBIn{}
+	r.Apply(u1)
+	rs := r.Lookup(PrePolicy, ipv4Unicast, prefix("10.0.0.0/8"))
+	if len(rs) != 2 || rs[0].PathID != 7 || rs[1].PathID != 9 {
+		t.Fatalf("expected paths 7 and 9, got %+v", rs)
+	}
+}
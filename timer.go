@@ -0,0 +1,94 @@
+package bgp
+
+// Hold timer and keepalive scheduling, RFC 4271, Sections 4.4 and 10.
+
+import (
+	"time"
+)
+
+// openHoldTime is the hold time used until the peer's OPEN is received.
+const openHoldTime = 4 * time.Minute
+
+// Clock is the source of time for the timers of a Session, it can be replaced
+// in tests.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine after d has elapsed.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer created by a Clock. *time.Timer implements it.
+type Timer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                            { return time.Now() }
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+func (s *Session) clock() Clock {
+	if s.Clock == nil {
+		return systemClock{}
+	}
+	return s.Clock
+}
+
+// startHold (re)starts the hold timer with d, a zero d stops it.
+func (s *Session) startHold(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hold != nil {
+		s.hold.Stop()
+		s.hold = nil
+	}
+	s.holdTime = d
+	if d > 0 && s.err == nil {
+		s.hold = s.clock().AfterFunc(d, s.holdExpired)
+	}
+}
+
+// resetHold restarts the hold timer, this is done for every received message.
+func (s *Session) resetHold() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hold != nil {
+		s.hold.Reset(s.holdTime)
+	}
+}
+
+// holdExpired ends the session with a Hold Timer Expired NOTIFICATION.
+func (s *Session) holdExpired() { s.notify(NewError(4, 0, "")) }
+
+// startKeepalive starts sending KEEPALIVEs, if the negotiated hold time is not zero.
+func (s *Session) startKeepalive() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state.HoldTime == 0 || s.err != nil {
+		return
+	}
+	s.keepalive = s.clock().AfterFunc(s.keepaliveInterval(), s.sendKeepalive)
+}
+
+func (s *Session) sendKeepalive() {
+	if err := s.write(&Keepalive{}); err != nil {
+		s.close(err)
+	}
+}
+
+// keepaliveInterval returns one third of the hold time, with a jitter that makes it
+// between 75% and 100% of that, RFC 4271, Section 10.
+func (s *Session) keepaliveInterval() time.Duration {
+	return jitter(time.Duration(s.state.HoldTime) * time.Second / 3)
+}
+
+// stopTimers stops all timers. The caller must hold s.mu.
+func (s *Session) stopTimers() {
+	if s.hold != nil {
+		s.hold.Stop()
+	}
+	if s.keepalive != nil {
+		s.keepalive.Stop()
+	}
+}
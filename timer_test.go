@@ -0,0 +1,118 @@
+package bgp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when Advance is called.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	c      *fakeClock
+	when   time.Time
+	f      func()
+	active bool
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{c: c, when: c.now.Add(d), f: f, active: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d and runs the functions of the timers that expire.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var fire []func()
+	for _, t := range c.timers {
+		if t.active && !t.when.After(c.now) {
+			t.active = false
+			fire = append(fire, t.f)
+		}
+	}
+	c.mu.Unlock()
+	for _, f := range fire {
+		f()
+	}
+}
+
+// active returns the number of timers that have not fired and are not stopped.
+func (c *fakeClock) active() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, t := range c.timers {
+		if t.active {
+			n++
+		}
+	}
+	return n
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	active := t.active
+	t.active = false
+	return active
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	active := t.active
+	t.when, t.active = t.c.now.Add(d), true
+	return active
+}
+
+func TestSessionHoldTimer(t *testing.T) {
+	ca, cb := &fakeClock{}, &fakeClock{}
+	a := &Session{AS: 65000, BGPIdentifier: net.IPv4(10, 0, 0, 1), HoldTime: 9, Clock: ca}
+	b := &Session{AS: 65001, BGPIdentifier: net.IPv4(10, 0, 0, 2), HoldTime: 30, Clock: cb}
+	if erra, errb := establish(t, a, b); erra != nil || errb != nil {
+		t.Fatalf("establish failed: %v, %v", erra, errb)
+	}
+	if a.State().HoldTime != 9 || b.State().HoldTime != 9 {
+		t.Fatalf("expected negotiated hold time 9, got %d and %d", a.State().HoldTime, b.State().HoldTime)
+	}
+
+	ca.Advance(3 * time.Second)
+	if m, err := b.ReadMsg(); err != nil {
+		t.Fatalf("read failed: %s", err)
+	} else if _, ok := m.(*Keepalive); !ok {
+		t.Fatalf("expected KEEPALIVE, got %T", m)
+	}
+
+	cb.Advance(9 * time.Second)
+	if _, err := b.ReadMsg(); !errors.Is(err, ErrHoldTimer) {
+		t.Fatalf("expected hold timer expired, got %v", err)
+	}
+	if _, err := a.ReadMsg(); !errors.Is(err, ErrHoldTimer) {
+		t.Fatalf("expected hold timer expired from peer, got %v", err)
+	}
+}
+
+func TestUnacceptableHoldTime(t *testing.T) {
+	s := &Session{AS: 65000, BGPIdentifier: net.IPv4(10, 0, 0, 1), HoldTime: 90}
+	err := s.negotiate(&Open{Version: Version, AS: 65001, HoldTime: 2, BGPIdentifier: net.IPv4(10, 0, 0, 2)})
+	if !errors.Is(err, ErrUnacceptableHoldTime) {
+		t.Fatalf("expected unacceptable hold time, got %v", err)
+	}
+}
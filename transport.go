@@ -0,0 +1,52 @@
+package bgp
+
+import (
+	"context"
+	"net"
+)
+
+// Transport sets up the TCP connections with peers. The zero value uses plain TCP.
+// Dial can be used as the Dial function of a Server.
+type Transport struct {
+	// Keys holds the keys used to authenticate the connections with peers. Only
+	// supported on Linux.
+	Keys []TCPKey
+	// TTLSecurity enables the Generalized TTL Security Mechanism (RFC 5082): packets
+	// are sent with a TTL of 255 and only accepted when they arrive with a TTL of at
+	// least 256 - MaxHops. Only supported on Linux.
+	TTLSecurity bool
+	// MaxHops is the number of hops a peer may be away with TTLSecurity, if zero
+	// peers must be directly connected.
+	MaxHops uint8
+	// TTL, if not zero, is the TTL of sent packets without TTLSecurity. Set it
+	// to 1 for directly connected eBGP peers, or larger for eBGP multihop.
+	TTL uint8
+}
+
+// TCPKey is the key used to authenticate the TCP connection with a peer, with either the
+// TCP MD5 signature option (RFC 2385) or TCP-AO (RFC 5925).
+type TCPKey struct {
+	Address net.IP // Address of the peer.
+	Key     string // At most 80 bytes.
+	// AO selects TCP-AO instead of TCP MD5, this needs Linux 6.7 or later.
+	AO bool
+	// Algorithm is the MAC algorithm used with TCP-AO, in the kernel's crypto API
+	// naming. If empty, "hmac(sha1)" is used.
+	Algorithm string
+	// SendID and RecvID are the TCP-AO key IDs, they must match the peer's RecvID and SendID.
+	SendID, RecvID uint8
+}
+
+// Dial connects to address on the named network, see net.Dial.
+func (t *Transport) Dial(network, address string) (net.Conn, error) {
+	d := &net.Dialer{Control: t.control}
+	return d.Dial(network, address)
+}
+
+// Listen announces on the local network address, see net.Listen. Connections are
+// accepted from the peers in Keys using their keys, and without authentication from
+// other peers.
+func (t *Transport) Listen(network, address string) (net.Listener, error) {
+	lc := &net.ListenConfig{Control: t.control}
+	return lc.Listen(context.Background(), network, address)
+}
@@ -0,0 +1,131 @@
+//go:build linux
+
+package bgp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+const (
+	tcpMD5Sig   = 14 // TCP_MD5SIG
+	tcpAOAddKey = 38 // TCP_AO_ADD_KEY
+
+	tcpMaxKeyLen = 80
+
+	ipv6MinHopCount = 73 // IPV6_MINHOPCOUNT
+)
+
+// control sets the socket options for c, network is "tcp4" or "tcp6".
+func (t *Transport) control(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = t.setsockopt(int(fd), network == "tcp6")
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func (t *Transport) setsockopt(fd int, inet6 bool) error {
+	if err := t.setTTL(fd, inet6); err != nil {
+		return err
+	}
+	for _, k := range t.Keys {
+		if k.Address.To4() == nil && !inet6 {
+			continue
+		}
+		if len(k.Key) > tcpMaxKeyLen {
+			return fmt.Errorf("bgp: key for %s longer than %d bytes", k.Address, tcpMaxKeyLen)
+		}
+		opt, buf := tcpMD5Sig, k.md5sig(inet6)
+		if k.AO {
+			opt, buf = tcpAOAddKey, k.aoAdd(inet6)
+		}
+		if err := syscall.SetsockoptString(fd, syscall.IPPROTO_TCP, opt, string(buf)); err != nil {
+			return fmt.Errorf("bgp: setting key for %s: %w", k.Address, err)
+		}
+	}
+	return nil
+}
+
+// setTTL sets the TTL of sent packets and the minimum TTL of received packets. On IPv6
+// sockets the IPv4 options are set as well, for IPv4-mapped addresses.
+func (t *Transport) setTTL(fd int, inet6 bool) error {
+	ttl, minTTL := int(t.TTL), 0
+	if t.TTLSecurity {
+		hops := int(t.MaxHops)
+		if hops == 0 {
+			hops = 1
+		}
+		ttl, minTTL = 255, 256-hops
+	}
+	if ttl == 0 {
+		return nil
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TTL, ttl); err != nil && !inet6 {
+		return fmt.Errorf("bgp: setting TTL: %w", err)
+	}
+	if minTTL > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MINTTL, minTTL); err != nil && !inet6 {
+			return fmt.Errorf("bgp: setting minimum TTL: %w", err)
+		}
+	}
+	if !inet6 {
+		return nil
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl); err != nil {
+		return fmt.Errorf("bgp: setting hop limit: %w", err)
+	}
+	if minTTL > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, ipv6MinHopCount, minTTL); err != nil {
+			return fmt.Errorf("bgp: setting minimum hop count: %w", err)
+		}
+	}
+	return nil
+}
+
+// md5sig returns struct tcp_md5sig for k.
+func (k TCPKey) md5sig(inet6 bool) []byte {
+	buf := make([]byte, 216)
+	putSockaddr(buf, k.Address, inet6)
+	binary.NativeEndian.PutUint16(buf[130:], uint16(len(k.Key)))
+	copy(buf[136:], k.Key)
+	return buf
+}
+
+// aoAdd returns struct tcp_ao_add for k.
+func (k TCPKey) aoAdd(inet6 bool) []byte {
+	buf := make([]byte, 288)
+	putSockaddr(buf, k.Address, inet6)
+	alg := k.Algorithm
+	if alg == "" {
+		alg = "hmac(sha1)"
+	}
+	copy(buf[128:191], alg)
+	binary.NativeEndian.PutUint32(buf[196:], 1|1<<1) // set_current and set_rnext
+	buf[202] = 32                                    // prefix
+	if inet6 {
+		buf[202] = 128
+	}
+	buf[203] = k.SendID
+	buf[204] = k.RecvID
+	buf[207] = byte(len(k.Key))
+	copy(buf[208:], k.Key)
+	return buf
+}
+
+// putSockaddr puts ip as a struct sockaddr_in or sockaddr_in6 in buf. IPv4 addresses
+// are mapped for IPv6 sockets.
+func putSockaddr(buf []byte, ip net.IP, inet6 bool) {
+	if !inet6 {
+		binary.NativeEndian.PutUint16(buf, syscall.AF_INET)
+		copy(buf[4:8], ip.To4())
+		return
+	}
+	binary.NativeEndian.PutUint16(buf, syscall.AF_INET6)
+	copy(buf[8:24], ip.To16())
+}
@@ -0,0 +1,64 @@
+package bgp
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestTransportMD5(t *testing.T) {
+	tr := &Transport{Keys: []TCPKey{{Address: net.IPv4(127, 0, 0, 1), Key: "secret"}}}
+	l, err := tr.Listen("tcp4", "127.0.0.1:0")
+	if errors.Is(err, syscall.ENOPROTOOPT) || errors.Is(err, syscall.EPERM) {
+		t.Skipf("TCP MD5 not supported: %s", err)
+	}
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.Write([]byte{1})
+			conn.Close()
+		}
+	}()
+
+	conn, err := tr.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 1)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+}
+
+func TestTransportTTLSecurity(t *testing.T) {
+	tr := &Transport{TTLSecurity: true}
+	l, err := tr.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := tr.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	defer conn.Close()
+	rc, _ := conn.(*net.TCPConn).SyscallConn()
+	rc.Control(func(fd uintptr) {
+		ttl, _ := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL)
+		min, _ := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MINTTL)
+		if ttl != 255 || min != 255 {
+			t.Errorf("expected TTL and minimum TTL 255, got %d and %d", ttl, min)
+		}
+	})
+}
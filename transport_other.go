@@ -0,0 +1,18 @@
+//go:build !linux
+
+package bgp
+
+import (
+	"errors"
+	"syscall"
+)
+
+func (t *Transport) control(network, address string, c syscall.RawConn) error {
+	if len(t.Keys) > 0 {
+		return errors.New("bgp: TCP authentication is only supported on Linux")
+	}
+	if t.TTLSecurity || t.TTL != 0 {
+		return errors.New("bgp: setting the TTL is only supported on Linux")
+	}
+	return nil
+}
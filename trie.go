@@ -0,0 +1,227 @@
+package bgp
+
+import (
+	"net"
+)
+
+// Trie is a compressed binary (Patricia) trie that maps IPv4 and IPv6 prefixes to
+// values. IPv4 and IPv6 prefixes are kept apart, an IPv4 prefix is never covered by an
+// IPv6 prefix. Iteration is in prefix order: by address, shorter prefixes first, IPv4
+// before IPv6. The zero value is an empty trie.
+type Trie[V any] struct {
+	root [2]*trieNode[V] // IPv4 and IPv6.
+	n    int
+}
+
+type trieNode[V any] struct {
+	key   net.IP // Masked to bits, 4 bytes for IPv4.
+	bits  int
+	val   V
+	set   bool // False for nodes that only join their children.
+	child [2]*trieNode[V]
+}
+
+// trieKey returns the masked address of p, the prefix length and the index of the root.
+func trieKey(p Prefix) (net.IP, int, int) {
+	bits := p.size()
+	if ip := p.IP.To4(); ip != nil && len(p.Mask) != net.IPv6len {
+		return ip.Mask(net.CIDRMask(bits, 32)), bits, 0
+	}
+	return p.IP.To16().Mask(net.CIDRMask(bits, 128)), bits, 1
+}
+
+func trieBit(key net.IP, i int) int { return int(key[i/8]>>(7-i%8)) & 1 }
+
+// commonBits returns the number of leading bits a and b have in common, at most max.
+func commonBits(a, b net.IP, max int) int {
+	n := 0
+	for i := 0; n < max && i < len(a); i++ {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// covers returns true if n is p or a less-specific of it.
+func (n *trieNode[V]) covers(key net.IP, bits int) bool {
+	return n.bits <= bits && commonBits(n.key, key, n.bits) == n.bits
+}
+
+func (n *trieNode[V]) prefix() Prefix {
+	return Prefix{IP: n.key, Mask: net.CIDRMask(n.bits, len(n.key)*8)}
+}
+
+// Len returns the number of prefixes in t.
+func (t *Trie[V]) Len() int { return t.n }
+
+// Insert sets the value for p to v.
+func (t *Trie[V]) Insert(p Prefix, v V) {
+	key, bits, r := trieKey(p)
+	np := &t.root[r]
+	for {
+		n := *np
+		if n == nil {
+			*np = &trieNode[V]{key: key, bits: bits, val: v, set: true}
+			t.n++
+			return
+		}
+		c := commonBits(n.key, key, min(n.bits, bits))
+		switch {
+		case c == n.bits && c == bits:
+			if !n.set {
+				t.n++
+			}
+			n.val, n.set = v, true
+			return
+		case c == n.bits:
+			np = &n.child[trieBit(key, c)]
+			continue
+		case c == bits:
+			nn := &trieNode[V]{key: key, bits: bits, val: v, set: true}
+			nn.child[trieBit(n.key, c)] = n
+			*np = nn
+		default:
+			join := &trieNode[V]{key: key.Mask(net.CIDRMask(c, len(key)*8)), bits: c}
+			join.child[trieBit(n.key, c)] = n
+			join.child[trieBit(key, c)] = &trieNode[V]{key: key, bits: bits, val: v, set: true}
+			*np = join
+		}
+		t.n++
+		return
+	}
+}
+
+// Get returns the value for p.
+func (t *Trie[V]) Get(p Prefix) (V, bool) {
+	key, bits, r := trieKey(p)
+	for n := t.root[r]; n != nil && n.covers(key, bits); n = n.child[trieBit(key, n.bits)] {
+		if n.bits == bits {
+			return n.val, n.set
+		}
+	}
+	var zero V
+	return zero, false
+}
+
+// Delete removes p and returns true if it was in t.
+func (t *Trie[V]) Delete(p Prefix) bool {
+	key, bits, r := trieKey(p)
+	var parent **trieNode[V]
+	np := &t.root[r]
+	for n := *np; n != nil && n.covers(key, bits); n = *np {
+		if n.bits == bits {
+			if !n.set {
+				return false
+			}
+			var zero V
+			n.val, n.set = zero, false
+			t.n--
+			compact(np)
+			if parent != nil {
+				compact(parent)
+			}
+			return true
+		}
+		parent = np
+		np = &n.child[trieBit(key, n.bits)]
+	}
+	return false
+}
+
+// compact removes the node at *np when it has no value and fewer than two children.
+func compact[V any](np **trieNode[V]) {
+	n := *np
+	if n.set {
+		return
+	}
+	switch {
+	case n.child[0] == nil:
+		*np = n.child[1]
+	case n.child[1] == nil:
+		*np = n.child[0]
+	}
+}
+
+// LongestMatch returns the most specific prefix in t that covers p, p included, and
+// its value. Use a host prefix (/32 or /128) to look up an address.
+func (t *Trie[V]) LongestMatch(p Prefix) (Prefix, V, bool) {
+	key, bits, r := trieKey(p)
+	var best *trieNode[V]
+	for n := t.root[r]; n != nil && n.covers(key, bits); {
+		if n.set {
+			best = n
+		}
+		if n.bits == bits {
+			break
+		}
+		n = n.child[trieBit(key, n.bits)]
+	}
+	if best == nil {
+		var zero V
+		return Prefix{}, zero, false
+	}
+	return best.prefix(), best.val, true
+}
+
+// LessSpecifics calls fn for all prefixes in t that cover p, p included, from the
+// shortest to the longest, until fn returns false.
+func (t *Trie[V]) LessSpecifics(p Prefix, fn func(Prefix, V) bool) {
+	key, bits, r := trieKey(p)
+	for n := t.root[r]; n != nil && n.covers(key, bits); {
+		if n.set && !fn(n.prefix(), n.val) {
+			return
+		}
+		if n.bits == bits {
+			return
+		}
+		n = n.child[trieBit(key, n.bits)]
+	}
+}
+
+// MoreSpecifics calls fn for all prefixes in t that are covered by p, p included, in
+// prefix order, until fn returns false.
+func (t *Trie[V]) MoreSpecifics(p Prefix, fn func(Prefix, V) bool) {
+	key, bits, r := trieKey(p)
+	n := t.root[r]
+	for n != nil && n.bits < bits {
+		if !n.covers(key, bits) {
+			return
+		}
+		n = n.child[trieBit(key, n.bits)]
+	}
+	if n != nil && commonBits(n.key, key, bits) == bits {
+		n.walk(fn)
+	}
+}
+
+// Walk calls fn for all prefixes in t in prefix order, until fn returns false.
+func (t *Trie[V]) Walk(fn func(Prefix, V) bool) {
+	for _, n := range t.root {
+		if n != nil && !n.walk(fn) {
+			return
+		}
+	}
+}
+
+func (n *trieNode[V]) walk(fn func(Prefix, V) bool) bool {
+	if n.set && !fn(n.prefix(), n.val) {
+		return false
+	}
+	for _, c := range n.child {
+		if c != nil && !c.walk(fn) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package bgp
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func TestTrie(t *testing.T) {
+	tr := &Trie[int]{}
+	for i, s := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.2.0.0/16", "0.0.0.0/0", "2001:db8::/32", "10.1.0.0/16"} {
+		tr.Insert(prefix(s), i)
+	}
+	if tr.Len() != 6 {
+		t.Fatalf("expected 6 prefixes, got %d", tr.Len())
+	}
+	if v, ok := tr.Get(prefix("10.1.0.0/16")); !ok || v != 6 {
+		t.Fatalf("expected replaced value 6, got %d", v)
+	}
+	if _, ok := tr.Get(prefix("10.0.0.0/12")); ok {
+		t.Fatalf("unexpected value for prefix not in trie")
+	}
+
+	if p, _, ok := tr.LongestMatch(prefix("10.1.2.3/32")); !ok || p.String() != "10.1.2.0/24" {
+		t.Fatalf("expected 10.1.2.0/24, got %s", p.String())
+	}
+	if p, _, ok := tr.LongestMatch(prefix("10.3.0.0/16")); !ok || p.String() != "10.0.0.0/8" {
+		t.Fatalf("expected 10.0.0.0/8, got %s", p.String())
+	}
+	if _, _, ok := tr.LongestMatch(prefix("2001:db9::/32")); ok {
+		t.Fatalf("IPv6 prefix must not match IPv4 default route")
+	}
+
+	collect := func(walk func(Prefix, func(Prefix, int) bool)) (ps []string) {
+		walk(prefix("10.1.0.0/16"), func(p Prefix, _ int) bool { ps = append(ps, p.String()); return true })
+		return ps
+	}
+	if ps := collect(tr.MoreSpecifics); len(ps) != 2 || ps[0] != "10.1.0.0/16" || ps[1] != "10.1.2.0/24" {
+		t.Fatalf("unexpected more-specifics: %v", ps)
+	}
+	if ps := collect(tr.LessSpecifics); len(ps) != 3 || ps[0] != "0.0.0.0/0" || ps[2] != "10.1.0.0/16" {
+		t.Fatalf("unexpected less-specifics: %v", ps)
+	}
+
+	var ps []string
+	tr.Walk(func(p Prefix, _ int) bool { ps = append(ps, p.String()); return true })
+	expect := []string{"0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.2.0.0/16", "2001:db8::/32"}
+	for i := range expect {
+		if i >= len(ps) || ps[i] != expect[i] {
+			t.Fatalf("expected %v, got %v", expect, ps)
+		}
+	}
+
+	for _, s := range expect {
+		if !tr.Delete(prefix(s)) {
+			t.Fatalf("failed to delete %s", s)
+		}
+	}
+	if tr.Len() != 0 || tr.root[0] != nil || tr.root[1] != nil {
+		t.Fatalf("expected empty trie")
+	}
+}
+
+// fullTable returns n random IPv4 prefixes with lengths between 8 and 24.
+func fullTable(n int) []Prefix {
+	r := rand.New(rand.NewSource(1))
+	ps := make([]Prefix, n)
+	for i := range ps {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, r.Uint32())
+		bits := 8 + r.Intn(17)
+		ps[i] = Prefix{IP: ip.Mask(net.CIDRMask(bits, 32)), Mask: net.CIDRMask(bits, 32)}
+	}
+	return ps
+}
+
+func BenchmarkTrieInsert(b *testing.B) {
+	ps := fullTable(1000000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr := &Trie[int]{}
+		for j, p := range ps {
+			tr.Insert(p, j)
+		}
+	}
+}
+
+func BenchmarkTrieLongestMatch(b *testing.B) {
+	ps := fullTable(1000000)
+	tr := &Trie[int]{}
+	for j, p := range ps {
+		tr.Insert(p, j)
+	}
+	hosts := fullTable(1024)
+	for i := range hosts {
+		hosts[i].Mask = net.CIDRMask(32, 32)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr.LongestMatch(hosts[i%len(hosts)])
+	}
+}
@@ -16,8 +16,9 @@ const (
 
 	headerLen = 19
 
-	MaxSize = 4096 // Maximum size of a BGP message.
-	Version = 4    // Current defined version of BGP.
+	MaxSize         = 4096  // Maximum size of a BGP message.
+	MaxExtendedSize = 65535 // Maximum size of a BGP message with extended messages, RFC 8654.
+	Version         = 4     // Current defined version of BGP.
 )
 
 // TLV is a Type-Length-Value that is used in all on-the-wire messages.
@@ -31,6 +32,17 @@ type TLV interface {
 	// maybe add Append here as well. Append(t int, v ...interface{}) error
 }
 
+// Raw is a TLV whose value is kept in wire format, it is used for parameters,
+// capabilities and path attributes this package does not know about.
+type Raw []byte
+
+func (r *Raw) Bytes() []byte { return []byte(*r) }
+
+func (r *Raw) SetBytes(buf []byte) (int, error) {
+	*r = append(Raw(nil), buf...)
+	return len(buf), nil
+}
+
 // Message is a BGP message.
 type Msg interface {
 	bytes() []byte
@@ -58,6 +70,11 @@ type Update struct {
 	WithdrawnRoutes  []Prefix
 	Attributes       []Attribute
 	ReachabilityInfo []Prefix
+	// WithdrawnPathIDs and PathIDs hold the path identifiers of WithdrawnRoutes and
+	// ReachabilityInfo when ADD-PATH (RFC 7911) is used for IPv4 unicast, otherwise
+	// they are nil.
+	WithdrawnPathIDs []uint32
+	PathIDs          []uint32
 
 	*header
 }
@@ -67,10 +84,20 @@ type Keepalive struct {
 	*header
 }
 
+// RouteRefresh asks the peer to send its routes for a family again. RFC 2918.
+type RouteRefresh struct {
+	Family
+	*header
+}
+
 // Notification holds an error. The TCP connection is closed after sending it.
 type Notification struct {
 	ErrorCode    uint8
 	ErrorSubcode uint8
 	Data         []byte
+	// Communication is the shutdown communication (RFC 9003) of a Cease with subcode
+	// Administrative Shutdown or Administrative Reset. If not empty it is used as the
+	// Data when converting to wire format, it is truncated to 255 bytes.
+	Communication string
 	*header
 }
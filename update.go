@@ -0,0 +1,238 @@
+package bgp
+
+// Revised error handling for UPDATE messages, RFC 7606.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Action is the way an error in an UPDATE message is handled. The actions are
+// ordered from least to most severe.
+type Action int
+
+const (
+	_                Action = iota
+	AttributeDiscard        // The malformed attribute is removed.
+	TreatAsWithdraw         // All routes in the UPDATE are withdrawn.
+	AfiSafiDisable          // The address family is disabled for the session.
+	SessionReset            // The session is closed with a NOTIFICATION.
+)
+
+var actionNames = map[Action]string{
+	AttributeDiscard: "attribute discard",
+	TreatAsWithdraw:  "treat-as-withdraw",
+	AfiSafiDisable:   "AFI/SAFI disable",
+	SessionReset:     "session reset",
+}
+
+func (a Action) String() string {
+	if s, ok := actionNames[a]; ok {
+		return s
+	}
+	return strconv.Itoa(int(a))
+}
+
+// attrActions holds the action for a malformed attribute, RFC 7606, Section 7.
+// Attributes not listed are handled with a session reset.
+var attrActions = map[uint8]Action{
+	origin:           TreatAsWithdraw,
+	path:             TreatAsWithdraw,
+	next_hop:         TreatAsWithdraw,
+	multi_exit_disc:  TreatAsWithdraw,
+	local_pref:       TreatAsWithdraw,
+	atomic_aggregate: AttributeDiscard,
+	aggregator:       AttributeDiscard,
+	communities:      TreatAsWithdraw,
+	mp_reach_nlri:    AfiSafiDisable,
+	mp_unreach_nlri:  AfiSafiDisable,
+	only_to_customer: TreatAsWithdraw, // RFC 9234, Section 5
+}
+
+// AttributeError is a single error found in an UPDATE message.
+type AttributeError struct {
+	Code   uint8  // Type code of the attribute, 0 if the error is not in an attribute.
+	Action Action // How this error is handled.
+	Err    *Error
+}
+
+// UpdateError holds all errors found while decoding an UPDATE message and how the
+// message was changed because of them.
+type UpdateError struct {
+	Action    Action // The most severe action of all errors.
+	Errors    []AttributeError
+	Withdrawn []Prefix // Prefixes that are treated as withdrawn.
+	Disabled  []Family // Address families that are disabled.
+}
+
+func (e *UpdateError) Error() string {
+	if len(e.Errors) == 0 {
+		return "bgp: UPDATE without errors"
+	}
+	s := "bgp: " + e.Action.String() + ": " + strings.TrimPrefix(e.Errors[0].Err.Error(), "bgp: ")
+	if len(e.Errors) > 1 {
+		s += fmt.Sprintf(" (and %d more)", len(e.Errors)-1)
+	}
+	return s
+}
+
+// Unwrap returns the errors in e, so errors.Is and errors.As look at all of them.
+func (e *UpdateError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i := range e.Errors {
+		errs[i] = e.Errors[i].Err
+	}
+	return errs
+}
+
+// add adds err with action to e and returns e.
+func (e *UpdateError) add(code uint8, action Action, err *Error) *UpdateError {
+	e.Errors = append(e.Errors, AttributeError{code, action, err})
+	if action > e.Action {
+		e.Action = action
+	}
+	return e
+}
+
+// attributeError adds the error err found in attribute a. For MP_REACH_NLRI and
+// MP_UNREACH_NLRI the family is disabled if it could be parsed, otherwise the
+// session must be reset.
+func (e *UpdateError) attributeError(a *Attribute, err *Error) {
+	action, ok := attrActions[a.Code]
+	if !ok {
+		e.add(a.Code, SessionReset, err)
+		return
+	}
+	if action != AfiSafiDisable {
+		e.add(a.Code, action, err)
+		return
+	}
+	var f Family
+	switch v := a.Value().(type) {
+	case *MPReach:
+		f = v.Family
+	case *MPUnreach:
+		f = v.Family
+	}
+	if f.AFI == 0 {
+		e.add(a.Code, SessionReset, err)
+		return
+	}
+	e.Disabled = append(e.Disabled, f)
+	e.add(a.Code, action, err)
+}
+
+// notification returns the error that should be sent to the peer in a NOTIFICATION.
+func (e *UpdateError) notification() *Error {
+	for _, a := range e.Errors {
+		if a.Action == e.Action {
+			return a.Err
+		}
+	}
+	return NewError(3, 0, "")
+}
+
+// apply changes m according to the errors in e. If there are no errors nil is
+// returned, otherwise e.
+func (e *UpdateError) apply(m *Update) error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	if e.Action == SessionReset {
+		return e
+	}
+	disabled := map[Family]bool{}
+	for _, f := range e.Disabled {
+		disabled[f] = true
+	}
+	m.removeFamilies(disabled)
+	for _, a := range e.Errors {
+		if a.Action == TreatAsWithdraw {
+			e.Withdrawn = m.treatAsWithdraw()
+			break
+		}
+	}
+	return e
+}
+
+// announces returns true if m announces any routes.
+func (m *Update) announces() bool {
+	return len(m.ReachabilityInfo) > 0 || findAttr(m.Attributes, mp_reach_nlri) != nil
+}
+
+// treatAsWithdraw turns all routes announced in m into withdrawn routes and removes all
+// attributes that are not needed for that. The prefixes that were announced are returned.
+func (m *Update) treatAsWithdraw() []Prefix {
+	withdrawn := append([]Prefix(nil), m.ReachabilityInfo...)
+	m.WithdrawnRoutes = append(m.WithdrawnRoutes, m.ReachabilityInfo...)
+	if m.PathIDs != nil {
+		m.WithdrawnPathIDs = append(m.WithdrawnPathIDs, m.PathIDs...)
+	}
+	m.ReachabilityInfo, m.PathIDs = nil, nil
+
+	var (
+		attrs   []Attribute
+		reaches []*MPReach
+	)
+	for _, a := range m.Attributes {
+		switch v := a.Value().(type) {
+		case *MPReach:
+			reaches = append(reaches, v)
+		case *MPUnreach:
+			attrs = append(attrs, a)
+		}
+	}
+	for _, r := range reaches {
+		withdrawn = append(withdrawn, r.NLRI...)
+		if a := findAttr(attrs, mp_unreach_nlri); a != nil && a.Value().(*MPUnreach).Family == r.Family {
+			u := a.Value().(*MPUnreach)
+			u.WithdrawnRoutes = append(u.WithdrawnRoutes, r.NLRI...)
+			if r.PathIDs != nil {
+				u.PathIDs = append(u.PathIDs, r.PathIDs...)
+			}
+			continue
+		}
+		a := Attribute{}
+		a.Append(mp_unreach_nlri, &MPUnreach{Family: r.Family, WithdrawnRoutes: r.NLRI, PathIDs: r.PathIDs})
+		attrs = append(attrs, a)
+	}
+	m.Attributes = attrs
+	return withdrawn
+}
+
+// removeFamilies removes the MP_REACH_NLRI and MP_UNREACH_NLRI attributes for the
+// families in disabled from m.
+func (m *Update) removeFamilies(disabled map[Family]bool) {
+	if len(disabled) == 0 {
+		return
+	}
+	attrs := m.Attributes[:0]
+	for _, a := range m.Attributes {
+		switch v := a.Value().(type) {
+		case *MPReach:
+			if disabled[v.Family] {
+				continue
+			}
+		case *MPUnreach:
+			if disabled[v.Family] {
+				continue
+			}
+		}
+		attrs = append(attrs, a)
+	}
+	m.Attributes = attrs
+}
+
+// withdrawals returns an UPDATE with only the withdrawn routes of m, or nil if m
+// does not withdraw anything.
+func (m *Update) withdrawals() *Update {
+	u := &Update{WithdrawnRoutes: m.WithdrawnRoutes, WithdrawnPathIDs: m.WithdrawnPathIDs}
+	if a := findAttr(m.Attributes, mp_unreach_nlri); a != nil {
+		u.Attributes = []Attribute{*a}
+	}
+	if len(u.WithdrawnRoutes) == 0 && len(u.Attributes) == 0 {
+		return nil
+	}
+	return u
+}
@@ -0,0 +1,312 @@
+package bgp
+
+import (
+	"slices"
+	"sync"
+)
+
+// UpdateGroups puts sessions with the same outbound configuration in the same group,
+// that shares one Adj-RIB-Out. Each UPDATE is encoded once per group and the bytes
+// are sent to all its sessions. An UpdateGroups can be used from multiple goroutines.
+type UpdateGroups struct {
+	// Policies holds the outbound policies by name.
+	Policies map[string]Policy
+	// MaxMessageSize is used for the Adj-RIB-Out of every group, it is limited to
+	// MaxSize for sessions that did not negotiate extended messages.
+	MaxMessageSize int
+
+	sendMu sync.Mutex // Serializes sending, so UPDATEs are sent in order.
+
+	mu      sync.Mutex
+	groups  map[groupKey]*updateGroup
+	member  map[*Session]*updateGroup
+	changes map[Family]map[string]Change // Last change of every prefix, for new groups.
+}
+
+// groupKey is the outbound configuration of a session. The role and our AS are part
+// of it because of the OTC attribute, the rest are the capabilities of the peer that
+// change the UPDATEs.
+type groupKey struct {
+	policy   string
+	role     Role
+	as       uint32
+	families string // Families of the peer.
+	addPath  string // Families in which multiple paths are sent.
+	extended bool   // Extended messages are negotiated.
+}
+
+type updateGroup struct {
+	key      groupKey
+	out      *AdjRIBOut
+	families []Family
+	sessions map[*Session]bool
+}
+
+// batch holds the encoded UPDATEs for sessions of a group.
+type batch struct {
+	bufs     []encoded
+	sessions []*Session
+}
+
+// Join adds s to the group for policy and its configuration, and sends it all routes
+// of the group. If s is in another group it leaves that first, so after a change of
+// configuration Join moves it to the right group, withdrawing the routes of the old
+// group that the new group does not advertise.
+func (g *UpdateGroups) Join(s *Session, policy string) error {
+	g.sendMu.Lock()
+	defer g.sendMu.Unlock()
+	g.mu.Lock()
+	st := s.State()
+	key := groupKey{policy: policy, role: s.Role, as: s.AS, extended: st.ExtendedMessage}
+	families := st.Families
+	if len(families) == 0 {
+		families = []Family{ipv4Unicast}
+	}
+	var addPath []Family
+	for _, f := range families {
+		key.families += string(f.bytes())
+		if st.SendPathIDs(f) {
+			addPath = append(addPath, f)
+			key.addPath += string(f.bytes())
+		}
+	}
+	old := g.member[s]
+	if old != nil {
+		if old.key == key {
+			g.mu.Unlock()
+			return nil
+		}
+		g.leave(s)
+	}
+	if g.groups == nil {
+		g.groups = map[groupKey]*updateGroup{}
+		g.member = map[*Session]*updateGroup{}
+	}
+	ug := g.groups[key]
+	if ug == nil {
+		size := g.MaxMessageSize
+		if !key.extended && size > MaxSize {
+			size = MaxSize
+		}
+		out := &AdjRIBOut{Policy: g.Policies[policy], MaxMessageSize: size, AddPath: addPath}
+		ug = &updateGroup{key: key, out: out, families: families, sessions: map[*Session]bool{}}
+		for _, prefixes := range g.changes {
+			for _, c := range prefixes {
+				ug.apply(c)
+			}
+		}
+		ug.out.Updates()
+		g.groups[key] = ug
+	}
+	ug.sessions[s] = true
+	g.member[s] = ug
+	ups := ug.out.all()
+	if old != nil {
+		ups = append(old.out.moved(ug.out), ups...)
+	}
+	b := ug.encode(ups, s)
+	g.mu.Unlock()
+	return g.write(b)
+}
+
+// Leave removes s from its group.
+func (g *UpdateGroups) Leave(s *Session) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.leave(s)
+}
+
+func (g *UpdateGroups) leave(s *Session) {
+	ug := g.member[s]
+	if ug == nil {
+		return
+	}
+	delete(ug.sessions, s)
+	delete(g.member, s)
+	if len(ug.sessions) == 0 {
+		delete(g.groups, ug.key)
+	}
+}
+
+// Apply sets the routes for the prefix of c in all groups, Flush sends the resulting
+// UPDATEs.
+func (g *UpdateGroups) Apply(c Change) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.changes == nil {
+		g.changes = map[Family]map[string]Change{}
+	}
+	if g.changes[c.Family] == nil {
+		g.changes[c.Family] = map[string]Change{}
+	}
+	if c.New == nil {
+		delete(g.changes[c.Family], c.Prefix.String())
+	} else {
+		g.changes[c.Family][c.Prefix.String()] = c
+	}
+	for _, ug := range g.groups {
+		ug.apply(c)
+	}
+}
+
+// apply applies c to the Adj-RIB-Out of ug, if the peers support its family.
+func (ug *updateGroup) apply(c Change) {
+	if slices.Contains(ug.families, c.Family) {
+		ug.out.Apply(c)
+	}
+}
+
+// Flush sends the UPDATEs for the changes since the last Flush to all sessions.
+// Sessions that fail are removed from their group and the first error is returned.
+func (g *UpdateGroups) Flush() error {
+	g.sendMu.Lock()
+	defer g.sendMu.Unlock()
+	g.mu.Lock()
+	var batches []batch
+	for _, ug := range g.groups {
+		batches = append(batches, ug.encode(ug.out.Updates(), nil))
+	}
+	g.mu.Unlock()
+	return g.write(batches...)
+}
+
+// Refresh sends all routes in family f of the group of s to s again, as needed after
+// receiving a ROUTE-REFRESH from its peer.
+func (g *UpdateGroups) Refresh(s *Session, f Family) error {
+	g.sendMu.Lock()
+	defer g.sendMu.Unlock()
+	g.mu.Lock()
+	ug := g.member[s]
+	if ug == nil {
+		g.mu.Unlock()
+		return nil
+	}
+	var ups []*Update
+	for _, u := range ug.out.all() {
+		if u.family() == f {
+			ups = append(ups, u)
+		}
+	}
+	b := ug.encode(ups, s)
+	g.mu.Unlock()
+	return g.write(b)
+}
+
+// encode encodes ups once for s, or for all sessions in ug if s is nil. The caller
+// must hold g.mu.
+func (ug *updateGroup) encode(ups []*Update, s *Session) batch {
+	var b batch
+	if s != nil {
+		b.sessions = []*Session{s}
+	} else {
+		for s := range ug.sessions {
+			b.sessions = append(b.sessions, s)
+		}
+	}
+	for _, u := range ups {
+		// The role and our AS are part of the key, so egress is the same for all sessions.
+		if u = egress(ug.key.role, ug.key.as, u); u != nil {
+			b.bufs = append(b.bufs, encoded(u.bytes()))
+		}
+	}
+	return b
+}
+
+// write sends the batches to their sessions, each session from its own goroutine so
+// a slow peer does not hold up the others. Sessions that fail are closed and removed
+// from their group and the first error is returned. The caller must hold g.sendMu,
+// but not g.mu.
+func (g *UpdateGroups) write(batches ...batch) error {
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		err error
+	)
+	for _, b := range batches {
+		if len(b.bufs) == 0 {
+			continue
+		}
+		for _, s := range b.sessions {
+			wg.Add(1)
+			go func(s *Session, bufs []encoded) {
+				defer wg.Done()
+				for _, buf := range bufs {
+					if e := s.write(buf); e != nil {
+						s.close(e)
+						g.Leave(s)
+						mu.Lock()
+						if err == nil {
+							err = e
+						}
+						mu.Unlock()
+						return
+					}
+				}
+			}(s, b.bufs)
+		}
+	}
+	wg.Wait()
+	return err
+}
+
+// encoded is a message in wire format, it is used to send the same bytes to multiple
+// sessions.
+type encoded []byte
+
+func (e encoded) bytes() []byte                { return e }
+func (e encoded) setBytes([]byte) (int, error) { return 0, errBuf }
+
+// all returns the UPDATEs that announce all advertised routes.
+func (r *AdjRIBOut) all() []*Update {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	size := r.maxMessageSize()
+	var ups []*Update
+	for f, prefixes := range r.advertised {
+		var routes []*Route
+		for _, rs := range prefixes {
+			routes = append(routes, rs...)
+		}
+		ups = append(ups, packUpdates(f, nil, routes, size, slices.Contains(r.AddPath, f))...)
+	}
+	return ups
+}
+
+// moved returns the UPDATEs that withdraw the routes advertised by r that to does not
+// advertise with the same path identifier, for a peer that moves from r to to. In
+// families where only one of them uses ADD-PATH all routes of r are withdrawn.
+func (r *AdjRIBOut) moved(to *AdjRIBOut) []*Update {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	to.mu.Lock()
+	defer to.mu.Unlock()
+	size := to.maxMessageSize()
+	var ups []*Update
+	for f, prefixes := range r.advertised {
+		addPath := slices.Contains(r.AddPath, f)
+		same := addPath == slices.Contains(to.AddPath, f)
+		var withdrawn []*Route
+		for key, routes := range prefixes {
+			for _, rt := range routes {
+				if !same || to.advertised.path(f, key, rt.PathID) == nil {
+					withdrawn = append(withdrawn, rt)
+				}
+			}
+		}
+		ups = append(ups, packUpdates(f, withdrawn, nil, size, addPath)...)
+	}
+	return ups
+}
+
+// family returns the family of the routes in u.
+func (m *Update) family() Family {
+	for _, a := range m.Attributes {
+		switch v := a.Value().(type) {
+		case *MPReach:
+			return v.Family
+		case *MPUnreach:
+			return v.Family
+		}
+	}
+	return ipv4Unicast
+}
@@ -0,0 +1,144 @@
+package bgp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestUpdateGroups(t *testing.T) {
+	var local, remote [2]*Session
+	for i := range local {
+		local[i] = &Session{AS: 65000, BGPIdentifier: net.IPv4(10, 0, 0, 1)}
+		remote[i] = &Session{AS: 65001 + uint32(i), BGPIdentifier: net.IPv4(10, 0, 0, 2)}
+		if erra, errb := establish(t, local[i], remote[i]); erra != nil || errb != nil {
+			t.Fatalf("establish failed: %v, %v", erra, errb)
+		}
+		defer local[i].Close()
+	}
+
+	g := &UpdateGroups{Policies: map[string]Policy{"none": func(Family, *Route) bool { return false }}}
+	if err := g.Join(local[0], "all"); err != nil {
+		t.Fatalf("join failed: %s", err)
+	}
+	rt := testRoute(0, 65000)
+	g.Apply(Change{Family: ipv4Unicast, Prefix: rt.Prefix, New: &PeerRoute{Route: rt}})
+	if err := g.Flush(); err != nil {
+		t.Fatalf("flush failed: %s", err)
+	}
+	if m, err := remote[0].ReadMsg(); err != nil || len(m.(*Update).ReachabilityInfo) != 1 {
+		t.Fatalf("expected UPDATE, got %v, %v", m, err)
+	}
+
+	// A session joining later gets all routes of the group.
+	errc := make(chan error)
+	go func() { errc <- g.Join(local[1], "all") }()
+	if m, err := remote[1].ReadMsg(); err != nil || len(m.(*Update).ReachabilityInfo) != 1 {
+		t.Fatalf("expected UPDATE, got %v, %v", m, err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("join failed: %s", err)
+	}
+	if len(g.groups) != 1 {
+		t.Fatalf("expected 1 group, got %d", len(g.groups))
+	}
+
+	// A different policy moves the session to a new group, the routes it rejects are
+	// withdrawn.
+	go func() { errc <- g.Join(local[1], "none") }()
+	m, err := remote[1].ReadMsg()
+	if err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if u := m.(*Update); len(u.WithdrawnRoutes) != 1 || u.WithdrawnRoutes[0].String() != rt.Prefix.String() {
+		t.Fatalf("expected withdrawal of %s, got %+v", rt.Prefix.String(), u)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("join failed: %s", err)
+	}
+	if len(g.groups) != 2 || g.member[local[1]].out.Count(ipv4Unicast) != 0 {
+		t.Fatalf("expected session in a group without routes")
+	}
+	g.Leave(local[0])
+	if len(g.groups) != 1 {
+		t.Fatalf("expected empty group to be removed")
+	}
+}
+
+func TestUpdateGroupsFailedSession(t *testing.T) {
+	local := &Session{AS: 65000, BGPIdentifier: net.IPv4(10, 0, 0, 1)}
+	remote := &Session{AS: 65001, BGPIdentifier: net.IPv4(10, 0, 0, 2)}
+	if erra, errb := establish(t, local, remote); erra != nil || errb != nil {
+		t.Fatalf("establish failed: %v, %v", erra, errb)
+	}
+	g := &UpdateGroups{}
+	if err := g.Join(local, "all"); err != nil {
+		t.Fatalf("join failed: %s", err)
+	}
+	local.Close()
+
+	// Two UPDATEs, the only member fails on the first.
+	a, b := testRoute(0, 65000), testRoute(10, 65000)
+	b.Prefix = prefix("10.1.0.0/16")
+	g.Apply(Change{Family: ipv4Unicast, Prefix: a.Prefix, New: &PeerRoute{Route: a}})
+	g.Apply(Change{Family: ipv4Unicast, Prefix: b.Prefix, New: &PeerRoute{Route: b}})
+	if err := g.Flush(); err == nil {
+		t.Fatal("expected flush to fail")
+	}
+	if len(g.groups) != 0 {
+		t.Fatalf("expected the empty group to be removed, got %d groups", len(g.groups))
+	}
+}
+
+func TestUpdateGroupsCapabilities(t *testing.T) {
+	g := &UpdateGroups{MaxMessageSize: MaxExtendedSize}
+	a := &Session{AS: 65000, state: State{ExtendedMessage: true}}
+	b := &Session{AS: 65000}
+	c := &Session{AS: 65000, state: State{AddPath: []AddPathFamily{{Family: ipv4Unicast, Send: true}}}}
+	for _, s := range []*Session{a, b, c} {
+		if err := g.Join(s, "all"); err != nil {
+			t.Fatalf("join failed: %s", err)
+		}
+	}
+	if len(g.groups) != 3 {
+		t.Fatalf("expected 3 groups, got %d", len(g.groups))
+	}
+	if g.member[a].out.MaxMessageSize != MaxExtendedSize || g.member[b].out.MaxMessageSize != MaxSize {
+		t.Fatal("expected extended messages only for the peer that supports them")
+	}
+	if len(g.member[c].out.AddPath) != 1 || len(g.member[b].out.AddPath) != 0 {
+		t.Fatal("expected ADD-PATH only for the peer that negotiated it")
+	}
+}
+
+func TestAdjRIBOutMoved(t *testing.T) {
+	a, b := testRoute(0, 65000), testRoute(10, 65000)
+	b.Prefix = prefix("10.1.0.0/16")
+	from := &AdjRIBOut{AddPath: []Family{ipv4Unicast}}
+	from.SetPaths(ipv4Unicast, a.Prefix, []*Route{a, a})
+	from.Set(ipv4Unicast, b.Prefix, b)
+	from.Updates()
+
+	// The same ADD-PATH mode: only the paths the new Adj-RIB-Out lacks are withdrawn.
+	to := &AdjRIBOut{AddPath: []Family{ipv4Unicast}}
+	to.Set(ipv4Unicast, a.Prefix, a)
+	to.Updates()
+	ups := from.moved(to)
+	if len(ups) != 1 || len(ups[0].WithdrawnRoutes) != 2 {
+		t.Fatalf("expected 2 withdrawn paths, got %+v", ups)
+	}
+	for i, p := range ups[0].WithdrawnRoutes {
+		id := ups[0].WithdrawnPathIDs[i]
+		if !(p.String() == a.Prefix.String() && id == 2) && !(p.String() == b.Prefix.String() && id == 1) {
+			t.Errorf("unexpected withdrawal of %s with path ID %d", p.String(), id)
+		}
+	}
+
+	// Without ADD-PATH in the new Adj-RIB-Out all paths are withdrawn with their old path IDs.
+	to = &AdjRIBOut{}
+	to.Set(ipv4Unicast, a.Prefix, a)
+	to.Updates()
+	ups = from.moved(to)
+	if len(ups) != 1 || len(ups[0].WithdrawnRoutes) != 3 || len(ups[0].WithdrawnPathIDs) != 3 {
+		t.Fatalf("expected 3 withdrawn paths, got %+v", ups)
+	}
+}